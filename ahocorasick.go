@@ -0,0 +1,195 @@
+package main
+
+import (
+	"sort"
+)
+
+// ahoCorasickMin is the number of the fixed strings from which they are
+// matched by the Aho-Corasick automaton instead of the regular expression.
+const ahoCorasickMin = 32
+
+// ahoCorasick is a Matcher of many fixed strings at once, in the time linear
+// in the length of the text. Like the alternation of the strings in a regular
+// expression, the leftmost match is found, the first of the strings if
+// several match there.
+type ahoCorasick struct {
+	nodes  []acNode
+	root   [256]int32 // the next nodes of the root, by the byte
+	maxLen int        // of the strings
+}
+
+// acNode is a node of the trie of the strings, the prefix of its depth
+// length.
+type acNode struct {
+	edges []acEdge // sorted by the byte
+	fail  int32    // the node of the longest proper suffix in the trie
+	dict  int32    // the node of the longest suffix being a string, or -1
+	index int32    // of the first string of the node, or -1
+	depth int32
+}
+
+type acEdge struct {
+	b    byte
+	node int32
+}
+
+// newAhoCorasick returns the automaton matching the non-empty strings.
+func newAhoCorasick(strs []string) *ahoCorasick {
+	ac := &ahoCorasick{nodes: []acNode{{index: -1, dict: -1}}}
+
+	for i, s := range strs {
+		n := int32(0)
+		for j := 0; j < len(s); j++ {
+			child := ac.child(n, s[j])
+			if child < 0 {
+				child = int32(len(ac.nodes))
+				ac.nodes = append(ac.nodes, acNode{index: -1, dict: -1, depth: int32(j + 1)})
+				ac.addEdge(n, s[j], child)
+			}
+			n = child
+		}
+		if ac.nodes[n].index < 0 {
+			ac.nodes[n].index = int32(i)
+		}
+		if len(s) > ac.maxLen {
+			ac.maxLen = len(s)
+		}
+	}
+
+	for b := range ac.root {
+		if child := ac.child(0, byte(b)); child > 0 {
+			ac.root[b] = child
+		}
+	}
+
+	// The failure and dictionary links, by breadth-first order so the
+	// links of the shallower nodes are set first.
+	queue := []int32{0}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+
+		for _, e := range ac.nodes[n].edges {
+			fail := int32(0)
+			if n != 0 {
+				fail = ac.next(ac.nodes[n].fail, e.b)
+			}
+			child := &ac.nodes[e.node]
+			child.fail = fail
+			if ac.nodes[fail].index >= 0 {
+				child.dict = fail
+			} else {
+				child.dict = ac.nodes[fail].dict
+			}
+			queue = append(queue, e.node)
+		}
+	}
+	return ac
+}
+
+// child returns the child of the node by the byte, or -1 if none.
+func (ac *ahoCorasick) child(n int32, b byte) int32 {
+	edges := ac.nodes[n].edges
+	lo, hi := 0, len(edges)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if edges[mid].b < b {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo < len(edges) && edges[lo].b == b {
+		return edges[lo].node
+	}
+	return -1
+}
+
+func (ac *ahoCorasick) addEdge(n int32, b byte, child int32) {
+	edges := ac.nodes[n].edges
+	i := sort.Search(len(edges), func(i int) bool { return edges[i].b >= b })
+	edges = append(edges, acEdge{})
+	copy(edges[i+1:], edges[i:])
+	edges[i] = acEdge{b, child}
+	ac.nodes[n].edges = edges
+}
+
+// next returns the node reached from the node by the byte.
+func (ac *ahoCorasick) next(n int32, b byte) int32 {
+	for n != 0 {
+		if child := ac.child(n, b); child >= 0 {
+			return child
+		}
+		n = ac.nodes[n].fail
+	}
+	return ac.root[b]
+}
+
+// matched reports whether any string ends at the node.
+func (ac *ahoCorasick) matched(n int32) bool {
+	return ac.nodes[n].index >= 0 || ac.nodes[n].dict >= 0
+}
+
+func (ac *ahoCorasick) MatchString(s string) bool {
+	n := int32(0)
+	for i := 0; i < len(s); i++ {
+		if n = ac.next(n, s[i]); ac.matched(n) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ac *ahoCorasick) Match(b []byte) bool {
+	n := int32(0)
+	for _, c := range b {
+		if n = ac.next(n, c); ac.matched(n) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ac *ahoCorasick) FindAllStringIndex(s string, limit int) [][]int {
+	var locs [][]int
+	for from := 0; from < len(s) && (limit < 0 || len(locs) < limit); {
+		loc := ac.find(s, from)
+		if loc == nil {
+			break
+		}
+		locs = append(locs, loc)
+		from = loc[1]
+	}
+	return locs
+}
+
+// find returns the location of the leftmost match in the s from the index,
+// of the first string matching there, or nil if none.
+func (ac *ahoCorasick) find(s string, from int) []int {
+	start, end, index := -1, -1, int32(-1)
+
+	n := int32(0)
+	for i := from; i < len(s); i++ {
+		// No match starting later than the best one may be better.
+		if start >= 0 && i >= start+ac.maxLen {
+			break
+		}
+
+		n = ac.next(n, s[i])
+		for m := n; m > 0; m = ac.nodes[m].dict {
+			node := &ac.nodes[m]
+			if node.index < 0 {
+				continue
+			}
+			st := i + 1 - int(node.depth)
+			if start < 0 || st < start || st == start && node.index < index {
+				start, end, index = st, i+1, node.index
+			}
+		}
+	}
+
+	if start < 0 {
+		return nil
+	}
+	return []int{start, end}
+}
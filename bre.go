@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+)
+
+// translateBRE translates the POSIX basic regular expression to the syntax
+// of the regexp package. The \( \) \{ \} \| \+ \? are the operators, their
+// unescaped forms are literals. The * is literal at the start of the
+// expression or a group, the ^ and $ are anchors only at the start and end
+// of the expression or a group. The \< \> are word boundaries.
+func translateBRE(pattern string) string {
+	var b strings.Builder
+
+	// start is true at the start of the expression or a group, where the
+	// * is literal and the ^ is an anchor.
+	start := true
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		atStart := start
+		start = false
+
+		switch c {
+		case '\\':
+			if i+1 == len(pattern) {
+				b.WriteString(`\\`)
+				continue
+			}
+			i++
+			switch e := pattern[i]; e {
+			case '(', '|':
+				b.WriteByte(e)
+				start = true
+			case ')', '{', '}', '+', '?':
+				b.WriteByte(e)
+			case '<', '>':
+				b.WriteString(`\b`)
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(e)
+			}
+		case '(', ')', '{', '}', '|', '+', '?':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '*':
+			if atStart {
+				b.WriteString(`\*`)
+			} else {
+				b.WriteByte(c)
+			}
+		case '^':
+			if atStart {
+				b.WriteByte(c)
+				start = true
+			} else {
+				b.WriteString(`\^`)
+			}
+		case '$':
+			if rest := pattern[i+1:]; rest == "" || strings.HasPrefix(rest, `\)`) || strings.HasPrefix(rest, `\|`) {
+				b.WriteByte(c)
+			} else {
+				b.WriteString(`\$`)
+			}
+		case '[':
+			i = translateBracket(&b, pattern, i)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// translateBracket writes the bracket expression starting at the i-th byte
+// of the pattern and returns the index of its closing bracket. The
+// backslash is literal in the bracket expression.
+func translateBracket(b *strings.Builder, pattern string, i int) int {
+	b.WriteByte('[')
+	i++
+
+	if i < len(pattern) && pattern[i] == '^' {
+		b.WriteByte('^')
+		i++
+	}
+	// The ] right after the opening bracket is literal.
+	if i < len(pattern) && pattern[i] == ']' {
+		b.WriteString(`\]`)
+		i++
+	}
+
+	for ; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case ']':
+			b.WriteByte(c)
+			return i
+		case '\\':
+			b.WriteString(`\\`)
+		case '[':
+			// Character classes like [:alpha:] are copied as they are.
+			if end := strings.Index(pattern[i:], ":]"); i+1 < len(pattern) && pattern[i+1] == ':' && end > 0 {
+				b.WriteString(pattern[i : i+end+2])
+				i += end + 1
+			} else {
+				b.WriteString(`\[`)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	// Unterminated bracket expression is left for the regexp package to
+	// report.
+	return i
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// chown does nothing, the owners are not kept on this platform.
+func chown(f *os.File, fi os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// colorReset is the SGR sequence ending a highlighted element.
+const colorReset = "\033[0m"
+
+// colors holds the SGR parameters of the highlighted elements of the output,
+// empty for the elements not highlighted.
+type colors struct {
+	match      string
+	filename   string
+	lineNumber string
+	byteOffset string
+	separator  string
+}
+
+// defaultColors are the colors of GNU grep.
+var defaultColors = colors{
+	match:      "01;31",
+	filename:   "35",
+	lineNumber: "32",
+	byteOffset: "32",
+	separator:  "36",
+}
+
+// parseColors returns the default colors modified by the GREP_COLORS like
+// spec, a colon separated list of capabilities such as ms=01;32 for the
+// matches, fn for the file names, ln for the line numbers, bn for the byte
+// offsets and se for the separators. The mt sets the color of the matches as
+// well. The other capabilities are ignored.
+func parseColors(spec string) colors {
+	c := defaultColors
+	for _, capability := range strings.Split(spec, ":") {
+		name, value, ok := strings.Cut(capability, "=")
+		if !ok {
+			continue
+		}
+		switch name {
+		case "mt", "ms":
+			c.match = value
+		case "fn":
+			c.filename = value
+		case "ln":
+			c.lineNumber = value
+		case "bn":
+			c.byteOffset = value
+		case "se":
+			c.separator = value
+		}
+	}
+	return c
+}
+
+// sgr returns the text wrapped in the SGR sequences of the parameters, or the
+// text as is if no parameters.
+func sgr(params, text string) string {
+	if params == "" || text == "" {
+		return text
+	}
+	return "\033[" + params + "m" + text + colorReset
+}
+
+// colorFlag is a flag.Value for the --color, one of auto, always or never.
+type colorFlag string
+
+func (c *colorFlag) String() string {
+	if c == nil {
+		return ""
+	}
+	return string(*c)
+}
+
+func (c *colorFlag) Set(s string) error {
+	switch s {
+	case "auto", "always", "never":
+		*c = colorFlag(s)
+		return nil
+	}
+	return fmt.Errorf("must be auto, always or never")
+}
+
+// enabled reports whether the output written to w is highlighted.
+func (c colorFlag) enabled(w io.Writer) bool {
+	switch c {
+	case "always":
+		return true
+	case "auto":
+		return isTerminal(w)
+	}
+	return false
+}
+
+// isTerminal reports whether the w is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+// highlight returns the text with the non-empty matches, as returned by
+// regexp.FindAllStringIndex, wrapped in the SGR sequences of the params. The
+// matches spanning lines, by the --multiline, are wrapped line by line.
+func highlight(text string, matches [][]int, params string) string {
+	if params == "" {
+		return text
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, loc := range matches {
+		if loc[0] == loc[1] {
+			continue
+		}
+		b.WriteString(text[last:loc[0]])
+		for i, line := range strings.Split(text[loc[0]:loc[1]], "\n") {
+			if i > 0 {
+				b.WriteString("\n")
+			}
+			if line != "" {
+				b.WriteString(sgr(params, line))
+			}
+		}
+		last = loc[1]
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
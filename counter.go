@@ -0,0 +1,40 @@
+package main
+
+// Counter counts what is selected by a search.
+type Counter struct {
+	Lines    int // the selected lines
+	Matches  int // the matches in them, only if counted or by the --stats
+	Files    int // with any selected line
+	Searched int // the files searched
+}
+
+// add adds the counts of the other Counter.
+func (c *Counter) add(other Counter) {
+	c.Lines += other.Lines
+	c.Matches += other.Matches
+	c.Files += other.Files
+	c.Searched += other.Searched
+}
+
+// Counts returns the counts of the last search. The -l, -L and -q, unless
+// the --count-to-stderr, stop reading a file at its first selected line,
+// which is the only one counted.
+func (g *Grepper) Counts() Counter {
+	return g.counts
+}
+
+// countingMatches reports whether the matches are counted instead of the
+// lines, by the --count-matches or the -c and --count-total with the -o. With
+// the -v, there are no matches to count.
+func (g *Grepper) countingMatches() bool {
+	return (g.CountMatches || g.counting() && g.OnlyMatching) && !g.Invert
+}
+
+// count returns the count of the matches, if counted, or of the lines, as
+// printed by the -c and limited by the -m.
+func (g *Grepper) count(c Counter) int {
+	if g.countingMatches() {
+		return c.Matches
+	}
+	return c.Lines
+}
@@ -0,0 +1,61 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDevices(t *testing.T) {
+	dir := t.TempDir()
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0o644); err != nil {
+		t.Skip("no FIFO:", err)
+	}
+
+	// Reading the FIFO would block, there is no writer.
+	tests := []struct {
+		opts  Options
+		paths []string
+	}{
+		{Options{Recursive: true}, []string{dir}},
+		{Options{Recursive: true, Devices: "skip"}, []string{dir}},
+		{Options{Devices: "skip"}, []string{fifo}},
+	}
+
+	for _, test := range tests {
+		bufout := &bytes.Buffer{}
+		buferr := &bytes.Buffer{}
+		g := &Grepper{Options: test.opts, Stdout: bufout, Stderr: buferr}
+
+		if match, err := g.Search("foo", test.paths); err != nil || match {
+			t.Errorf("%+v: expected no match, got error %v", test.opts, err)
+		}
+		if bufout.Len() > 0 || buferr.Len() > 0 {
+			t.Errorf("%+v: expected no output, got %q and %q", test.opts, bufout, buferr)
+		}
+		if g.Counts().Searched != 0 {
+			t.Errorf("%+v: expected the FIFO skipped", test.opts)
+		}
+	}
+
+	go func() {
+		if err := os.WriteFile(fifo, []byte("foo\n"), 0o644); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	bufout := &bytes.Buffer{}
+	g := &Grepper{Options: Options{Recursive: true, Devices: "read"}, Stdout: bufout, Stderr: &bytes.Buffer{}}
+	if match, err := g.Search("foo", []string{dir}); err != nil || !match {
+		t.Fatal("expected match")
+	}
+	expected := fifo + ":foo\n"
+	if bufout.String() != expected {
+		t.Fatalf("expected %q got %q", expected, bufout.String())
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// encodingFlag is a flag.Value for the --encoding, the name of the encoding
+// of the input, transcoded to UTF-8 before searching.
+type encodingFlag string
+
+func (e *encodingFlag) String() string {
+	if e == nil {
+		return ""
+	}
+	return string(*e)
+}
+
+func (e *encodingFlag) Set(s string) error {
+	s = strings.ToLower(s)
+	if _, ok := decoders[s]; !ok {
+		return errors.New("must be auto, utf-8, latin1, utf-16, utf-16le or utf-16be")
+	}
+	*e = encodingFlag(s)
+	return nil
+}
+
+// decoders decode a rune of the input by the name of its encoding. The
+// invalid sequences are decoded as utf8.RuneError.
+var decoders = map[string]func(*bufio.Reader) (rune, error){
+	"auto":       nil, // by the byte order mark
+	"utf-8":      decodeUTF8,
+	"utf8":       decodeUTF8,
+	"latin1":     decodeLatin1,
+	"iso-8859-1": decodeLatin1,
+	"utf-16":     decodeUTF16BE,
+	"utf-16le":   decodeUTF16LE,
+	"utf-16be":   decodeUTF16BE,
+}
+
+// decode returns the input transcoded from the encoding to UTF-8. The utf-16
+// is little or big endian by its byte order mark, big endian by default. The
+// auto is the encoding of the byte order mark, the input without one is
+// returned as is.
+func (e encodingFlag) decode(in io.Reader) io.Reader {
+	br := bufio.NewReader(in)
+	decode := decoders[string(e)]
+
+	if e == "auto" {
+		decode = sniffBOM(br)
+		if decode == nil {
+			return br
+		}
+	}
+
+	if e == "utf-16" {
+		switch bom, _ := br.Peek(2); string(bom) {
+		case "\xff\xfe":
+			decode = decodeUTF16LE
+			br.Discard(2)
+		case "\xfe\xff":
+			br.Discard(2)
+		}
+	}
+	return &transcoder{r: br, decode: decode}
+}
+
+// boms are the byte order marks of the encodings, the longer ones first as
+// the utf-32le one starts with the utf-16le one.
+var boms = []struct {
+	bom    string
+	decode func(*bufio.Reader) (rune, error)
+}{
+	{"\x00\x00\xfe\xff", decodeUTF32BE},
+	{"\xff\xfe\x00\x00", decodeUTF32LE},
+	{"\xef\xbb\xbf", decodeUTF8},
+	{"\xfe\xff", decodeUTF16BE},
+	{"\xff\xfe", decodeUTF16LE},
+}
+
+// sniffBOM discards the byte order mark the input starts with, returning the
+// decoder of its encoding, or nil if there is none.
+func sniffBOM(r *bufio.Reader) func(*bufio.Reader) (rune, error) {
+	for _, b := range boms {
+		if head, _ := r.Peek(len(b.bom)); string(head) == b.bom {
+			r.Discard(len(b.bom))
+			return b.decode
+		}
+	}
+	return nil
+}
+
+// transcoder reads the runes decoded from the underlying reader as UTF-8.
+type transcoder struct {
+	r      *bufio.Reader
+	decode func(*bufio.Reader) (rune, error)
+	buf    []byte // decoded, not read yet
+	err    error
+}
+
+func (t *transcoder) Read(p []byte) (int, error) {
+	for len(t.buf) < len(p) && t.err == nil {
+		var r rune
+		r, t.err = t.decode(t.r)
+		if t.err == nil {
+			t.buf = utf8.AppendRune(t.buf, r)
+		}
+	}
+
+	n := copy(p, t.buf)
+	t.buf = append(t.buf[:0], t.buf[n:]...)
+	if n == 0 {
+		return 0, t.err
+	}
+	return n, nil
+}
+
+func decodeUTF8(r *bufio.Reader) (rune, error) {
+	c, _, err := r.ReadRune()
+	return c, err
+}
+
+func decodeLatin1(r *bufio.Reader) (rune, error) {
+	b, err := r.ReadByte()
+	return rune(b), err
+}
+
+func decodeUTF16LE(r *bufio.Reader) (rune, error) {
+	return decodeUTF16(r, func(b []byte) uint16 { return uint16(b[0]) | uint16(b[1])<<8 })
+}
+
+func decodeUTF16BE(r *bufio.Reader) (rune, error) {
+	return decodeUTF16(r, func(b []byte) uint16 { return uint16(b[0])<<8 | uint16(b[1]) })
+}
+
+// decodeUTF16 decodes a rune of one or two, for a surrogate pair, code units
+// of the order. A trailing odd byte is invalid.
+func decodeUTF16(r *bufio.Reader, order func([]byte) uint16) (rune, error) {
+	b, err := r.Peek(2)
+	switch {
+	case len(b) == 1:
+		r.Discard(1)
+		return utf8.RuneError, nil
+	case err != nil:
+		return 0, err
+	}
+	r.Discard(2)
+
+	c := rune(order(b))
+	if !utf16.IsSurrogate(c) {
+		return c, nil
+	}
+
+	// The low surrogate of a pair is consumed only if it is valid.
+	if b, err := r.Peek(2); err == nil {
+		if c := utf16.DecodeRune(c, rune(order(b))); c != utf8.RuneError {
+			r.Discard(2)
+			return c, nil
+		}
+	}
+	return utf8.RuneError, nil
+}
+
+func decodeUTF32LE(r *bufio.Reader) (rune, error) {
+	return decodeUTF32(r, func(b []byte) uint32 {
+		return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	})
+}
+
+func decodeUTF32BE(r *bufio.Reader) (rune, error) {
+	return decodeUTF32(r, func(b []byte) uint32 {
+		return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	})
+}
+
+// decodeUTF32 decodes a rune of a code unit of the order. The surrogates, the
+// code units out of the range and the trailing bytes short of one are invalid.
+func decodeUTF32(r *bufio.Reader, order func([]byte) uint32) (rune, error) {
+	b, err := r.Peek(4)
+	switch {
+	case len(b) > 0 && len(b) < 4:
+		r.Discard(len(b))
+		return utf8.RuneError, nil
+	case err != nil:
+		return 0, err
+	}
+	r.Discard(4)
+
+	c := order(b)
+	if c > utf8.MaxRune || utf16.IsSurrogate(rune(c)) {
+		return utf8.RuneError, nil
+	}
+	return rune(c), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// followPoll is the interval the file followed by the --follow is checked
+// for the lines appended.
+const followPoll = 100 * time.Millisecond
+
+// checkFollow returns an error if the options or the files are not supported
+// with the --follow.
+func (g *Grepper) checkFollow(globs []string) error {
+	if !g.Follow {
+		return nil
+	}
+
+	switch {
+	case len(globs) == 0 && g.FilesFrom == "" || len(globs) == 1 && globs[0] == "-":
+		return errors.New("--follow does not follow the standard input")
+	case len(globs) != 1 || g.FilesFrom != "" || g.Recursive || g.Dereference:
+		return errors.New("--follow follows only one file")
+	case g.Multiline || g.Rewrite != "" || g.Gzip || g.Sort != "":
+		return errors.New("--follow is not supported with the --multiline, --rewrite, --gzip or --sort")
+	}
+	return nil
+}
+
+// followFile searches the open file like the grepFile, then the lines
+// appended to it until the search is canceled or the Timeout.
+func (g *Grepper) followFile(name string, f *os.File, pattern Matcher) (bool, error) {
+	ctx := g.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if g.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.Timeout)
+		defer cancel()
+	}
+
+	r := &followReader{name: name, f: f, ctx: ctx}
+	defer r.close()
+
+	// The head is read where it is, the reader would wait for the rest.
+	head := make([]byte, binaryPeek)
+	n, _ := f.ReadAt(head, 0)
+	head = head[:n]
+
+	var in io.Reader = r
+	if g.Encoding != "" {
+		head, _ = ioutil.ReadAll(g.Encoding.decode(bytes.NewReader(head)))
+		in = g.Encoding.decode(in)
+	}
+
+	g.counts.Searched++
+	return g.grepLines(g.displayName(name), head, g.newLineScanner(in), pattern)
+}
+
+// followReader reads the named file, waiting for more at its end until the
+// ctx is done. The file truncated is read again from its beginning, the name
+// renamed and created again is reopened, like rotated logs.
+type followReader struct {
+	name     string
+	f        *os.File
+	offset   int64 // read of the f
+	reopened bool  // the f is opened by the reader
+	ctx      context.Context
+}
+
+func (r *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.f.Read(p)
+		if n > 0 || err != io.EOF {
+			r.offset += int64(n)
+			return n, err
+		}
+
+		select {
+		case <-r.ctx.Done():
+			return 0, io.EOF
+		case <-time.After(followPoll):
+		}
+		r.check()
+	}
+}
+
+// check reopens the file if its name is of another one, or reads it again
+// from the beginning if truncated.
+func (r *followReader) check() {
+	fi, err := os.Stat(r.name)
+	if err != nil {
+		// Removed, it may be created again.
+		return
+	}
+
+	if cur, err := r.f.Stat(); err == nil && !os.SameFile(fi, cur) {
+		f, err := os.Open(r.name)
+		if err != nil {
+			return
+		}
+		r.close()
+		r.f, r.offset, r.reopened = f, 0, true
+		return
+	}
+
+	if fi.Size() < r.offset {
+		if _, err := r.f.Seek(0, io.SeekStart); err == nil {
+			r.offset = 0
+		}
+	}
+}
+
+// close closes the file if opened by the reader.
+func (r *followReader) close() {
+	if r.reopened {
+		r.f.Close()
+	}
+}
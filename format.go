@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Formatter formats the output of a search, called by the Grepper in the
+// order of the output. The Formatter of the Grepper replaces the one of the
+// options, the files are then searched by one job. The TextFormatter,
+// HeadingFormatter and JSONFormatter of the options can be embedded in it to
+// change only a part of their output.
+type Formatter interface {
+	// FileHeader is called before the first line printed of each file.
+	FileHeader(name string)
+	// Line is called for each line printed, selected or of the context.
+	Line(r Result)
+	// Separator is called between the groups of lines with context, of
+	// different files if file.
+	Separator(file bool)
+	// Count is called for the count of the file by the -c, or of all the
+	// files named (total) by the --count-total.
+	Count(name string, n int)
+	// Name is called for the name of the file listed by the -l or -L.
+	Name(name string)
+	// Binary is called instead of Line for the binary file with a selected
+	// line, whose lines are not printed.
+	Binary(name string)
+}
+
+// totalName is the name of the count of all the files.
+const totalName = "(total)"
+
+// formatter returns the Formatter of the options, writing to the output of
+// the search.
+func (g *Grepper) formatter() Formatter {
+	switch {
+	case g.results != nil:
+		return NewTextFormatter(g)
+	case g.JSON:
+		return NewJSONFormatter(g)
+	case g.Heading:
+		return NewHeadingFormatter(g)
+	}
+	return NewTextFormatter(g)
+}
+
+// TextFormatter prints the lines prefixed by the file name, the line number,
+// the column and the byte offset if requested, the default output.
+type TextFormatter struct {
+	g *Grepper
+}
+
+// NewTextFormatter returns the TextFormatter writing to the output of the
+// searches of the Grepper, as by its options.
+func NewTextFormatter(g *Grepper) TextFormatter {
+	return TextFormatter{g}
+}
+
+func (f TextFormatter) FileHeader(name string) {}
+
+func (f TextFormatter) Line(r Result) {
+	f.line(r, f.g.printName)
+}
+
+// line prints the line, prefixed by its file name if named.
+func (f TextFormatter) line(r Result, named bool) {
+	g := f.g
+	sep := ":"
+	if r.Context {
+		sep = "-"
+	}
+
+	if named {
+		g.printFilename(r.Name, sep)
+	}
+	sep = g.field(sep)
+
+	if g.LineNumbers {
+		fmt.Fprint(g.stdout, sgr(g.colors.lineNumber, g.pad(strconv.Itoa(r.Number))))
+		fmt.Fprint(g.stdout, sgr(g.colors.separator, sep))
+	}
+
+	if r.Column > 0 {
+		fmt.Fprint(g.stdout, sgr(g.colors.lineNumber, g.pad(strconv.Itoa(r.Column))))
+		fmt.Fprint(g.stdout, sgr(g.colors.separator, sep))
+	}
+
+	if g.ByteOffset {
+		fmt.Fprint(g.stdout, sgr(g.colors.byteOffset, g.pad(strconv.FormatInt(r.Offset, 10))))
+		fmt.Fprint(g.stdout, sgr(g.colors.separator, sep))
+	}
+
+	if g.InitialTab && (named || g.LineNumbers || r.Column > 0 || g.ByteOffset) {
+		io.WriteString(g.stdout, "\t")
+	}
+
+	// The context lines are not highlighted, but those of the --passthru.
+	text := r.Text
+	if g.colorize && len(r.Matches) > 0 && (!r.Context || g.passthru()) {
+		text = highlight(text, r.Matches, g.colors.match)
+	}
+
+	fmt.Fprint(g.stdout, text, g.outputEnd())
+}
+
+// pad pads the number of the prefixes to four characters by the -T.
+func (g *Grepper) pad(n string) string {
+	if g.InitialTab && len(n) < 4 {
+		return strings.Repeat(" ", 4-len(n)) + n
+	}
+	return n
+}
+
+func (f TextFormatter) Separator(file bool) {
+	if file {
+		io.WriteString(f.g.stdout, f.g.fileSeparator())
+		return
+	}
+	io.WriteString(f.g.stdout, f.g.groupSeparator())
+}
+
+func (f TextFormatter) Count(name string, n int) {
+	if f.g.printName || name == totalName {
+		f.g.printFilename(name, ":")
+	}
+	fmt.Fprintln(f.g.stdout, n)
+}
+
+func (f TextFormatter) Name(name string) {
+	if f.g.printName {
+		f.g.printFilename(name, "\n")
+	}
+}
+
+func (f TextFormatter) Binary(name string) {
+	fmt.Fprintf(f.g.stdout, "Binary file %s matches\n", name)
+}
+
+// HeadingFormatter prints the name of the file once above its lines, by the
+// --heading.
+type HeadingFormatter struct {
+	TextFormatter
+}
+
+// NewHeadingFormatter returns the HeadingFormatter writing to the output of
+// the searches of the Grepper, as by its options.
+func NewHeadingFormatter(g *Grepper) HeadingFormatter {
+	return HeadingFormatter{TextFormatter{g}}
+}
+
+func (f HeadingFormatter) FileHeader(name string) {
+	if f.g.printName {
+		f.g.printHeading(name)
+	}
+}
+
+func (f HeadingFormatter) Line(r Result) {
+	f.line(r, false)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// gitignore holds the patterns of the .gitignore files of the directories
+// walked, by the --gitignore, by the cleaned path of the directory.
+type gitignore map[string][]ignorePattern
+
+// ignorePattern is a pattern of a .gitignore file.
+type ignorePattern struct {
+	elems    []string // of the pattern, separated by the slashes
+	negate   bool     // the ! includes again the paths matching
+	dirOnly  bool     // the trailing slash matches only directories
+	anchored bool     // matches the path from the directory, not the base name
+}
+
+// load reads the patterns of the .gitignore file of the directory, if any.
+func (gi gitignore) load(dir string) {
+	dir = filepath.Clean(dir)
+	data, err := os.ReadFile(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return
+	}
+	gi[dir] = parseGitignore(string(data))
+}
+
+// parseGitignore parses the patterns of the content of a .gitignore file,
+// skipping the blank lines and the comments.
+func parseGitignore(data string) []ignorePattern {
+	var patterns []ignorePattern
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+			line = line[:len(line)-1]
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		var p ignorePattern
+		switch {
+		case line[0] == '!':
+			p.negate = true
+			line = line[1:]
+		case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		p.anchored = strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+
+		p.elems = strings.Split(line, "/")
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+// ignored reports whether the path found under the root is ignored by the
+// patterns loaded of the directories from the root down to the path. The last
+// pattern matching decides, those of the deeper directories come last.
+func (gi gitignore) ignored(root, name string, dir bool) bool {
+	root = filepath.Clean(root)
+	var dirs []string
+	for d := filepath.Dir(name); ; d = filepath.Dir(d) {
+		dirs = append(dirs, d)
+		if d == root || d == filepath.Dir(d) {
+			break
+		}
+	}
+
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(dirs[i], name)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		for _, p := range gi[dirs[i]] {
+			if p.match(rel, dir) {
+				ignored = !p.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// match reports whether the pattern matches the path, relative to the
+// directory of its .gitignore file and separated by slashes.
+func (p ignorePattern) match(rel string, dir bool) bool {
+	if p.dirOnly && !dir {
+		return false
+	}
+	if !p.anchored {
+		ok, _ := path.Match(p.elems[0], path.Base(rel))
+		return ok
+	}
+	return matchElems(p.elems, strings.Split(rel, "/"))
+}
+
+// matchElems reports whether the elements of the pattern match those of the
+// path. The ** element matches any number of them, none too.
+func matchElems(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if matchElems(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
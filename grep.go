@@ -3,66 +3,516 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
-var Flags struct {
+// Options configures the search. The fields correspond to the command line
+// flags, except the Colors to the GREP_COLORS environment variable.
+type Options struct {
+	AfterContext      int
+	BasicRegexp       bool
+	Basename          bool
+	BeforeContext     int
+	Binary            bool
+	ByteOffset        bool
+	Color             colorFlag
+	Colors            string
+	Column            columnFlag
+	Confirm           bool
+	Context           int
+	CountMatches      bool
 	CountOnly         bool
+	CountToStderr     bool
+	CountTotal        bool
+	Dereference       bool
+	Devices           devicesFlag
+	Encoding          encodingFlag
+	Exclude           globList
+	ExcludeDir        globList
+	ExtendedRegexp    bool
+	FieldSeparator    string
+	FileBoundaries    bool
+	FilesFrom         string
 	FilesWithMatch    bool
 	FilesWithoutMatch bool
+	FixedStrings      bool
+	Follow            bool
+	FullPath          bool
+	Gitignore         bool
+	GroupSeparator    string
+	Gzip              bool
+	Heading           bool
+	Hidden            bool
+	IgnoreCase        bool
+	Include           globList
+	IncludeZero       bool
+	InitialTab        bool
 	Invert            bool
+	Label             string
+	Jobs              int
+	JSON              bool
+	LineBuffered      bool
+	LineMatch         bool
+	LineTerminator    terminatorFlag
 	LineNumbers       bool
+	MaxCount          int
+	MaxDepth          depthFlag
+	MaxFilesize       byteSize
+	MaxLineLength     int
+	Mmap              bool
+	Multiline         bool
 	NoErrorMessages   bool
 	NoFilename        bool
+	NoGroupSeparator  bool
+	NullData          bool
+	NullName          bool
+	OnlyGroup         int
+	OnlyMatching      bool
+	Passthru          bool
+	Perl              bool
+	Posix             bool
 	Quiet             bool
+	Recursive         bool
+	Replace           string
+	Rewrite           string
+	SkipBinary        bool
+	Sort              sortFlag
+	SortReverse       bool
+	Stats             bool
+	Text              bool
+	TextOnly          bool
+	Timeout           time.Duration
+	TotalMax          int
+	Truncate          bool
+	Unique            bool
+	UniqueGlobal      bool
+	WithFilename      bool
+	WordMatch         bool
 }
 
-var (
-	printName bool
-	stderr    io.Writer = os.Stderr
-	stdin     io.Reader = os.Stdin
-	stdout    io.Writer = os.Stdout
-)
+// Flags holds the options set by the command line flags.
+var Flags Options
 
 func init() {
+	flag.IntVar(&Flags.AfterContext, "A", 0, `
+	Print NUM lines of trailing context after matching lines. Places a
+	line containing -- between contiguous groups of matches.`)
+
+	flag.IntVar(&Flags.AfterContext, "after-context", 0, `
+	Same as the -A.`)
+
+	flag.Var(exclusiveFlag{&Flags.BasicRegexp, &Flags.ExtendedRegexp}, "G", `
+	Interpret the pattern as a POSIX basic regular expression. The last
+	one of -E and -G given wins.`)
+
+	flag.Var(exclusiveFlag{&Flags.Basename, &Flags.FullPath}, "basename", `
+	Print only the base name of the files, without their directory. The
+	files of the same name in different directories are not told apart.
+	The last one of --basename and --full-path given wins.`)
+
+	flag.IntVar(&Flags.BeforeContext, "B", 0, `
+	Print NUM lines of leading context before matching lines. Places a
+	line containing -- between contiguous groups of matches.`)
+
+	flag.IntVar(&Flags.BeforeContext, "before-context", 0, `
+	Same as the -B.`)
+
+	flag.Var(exclusiveFlag{&Flags.Text, &Flags.SkipBinary}, "a", `
+	Process a binary file as if it were text, printing the matching lines
+	as they are. The last one of -a and -I given wins.`)
+
+	flag.BoolVar(&Flags.Binary, "U", false, `
+	Keep the carriage return at the end of the lines terminated by CRLF.
+	By default it is stripped, so the $ matches before it.`)
+
+	flag.BoolVar(&Flags.Binary, "binary", false, `
+	Same as the -U.`)
+
+	flag.BoolVar(&Flags.ByteOffset, "b", false, `
+	Print the 0-based byte offset within the input file before each line
+	of output. With the -o, print the offset of the matching part.`)
+
+	flag.Var(&Flags.Color, "color", `
+	Highlight the matching parts of lines, one of auto, always or never.
+	The auto highlights only if the output is a terminal. The colors are
+	set by the GREP_COLORS environment variable as in GNU grep.`)
+
+	flag.Var(&Flags.Color, "colour", `
+	Same as the --color.`)
+
+	flag.Var(&Flags.Column, "column", `
+	Print the 1-based column of the first match before each matching
+	line, after the line number. With the -o, print the column of each
+	match. The column counts bytes, or the characters with --column=rune.`)
+
+	flag.BoolVar(&Flags.Confirm, "confirm", false, `
+	With the --rewrite, confirm the files are rewritten without keeping
+	their backup.`)
+
+	flag.IntVar(&Flags.Context, "C", 0, `
+	Print NUM lines of leading and trailing context. The -A and -B take
+	precedence if they ask for more lines.`)
+
+	flag.IntVar(&Flags.Context, "context", 0, `
+	Same as the -C.`)
+
 	flag.BoolVar(&Flags.CountOnly, "c", false, `
 	Suppress normal output; instead print a count of matching lines for
-	each input file. With the -v, count non-matching lines.`)
+	each input file. With the -o, count the matches instead, like the
+	--count-matches. With the -v, count non-matching lines.`)
+
+	flag.BoolVar(&Flags.CountMatches, "count-matches", false, `
+	Like the -c, but count the matches, not the matching lines. The -m
+	limits the count of the matches. With the -v, count non-matching
+	lines.`)
+
+	flag.BoolVar(&Flags.CountToStderr, "count-to-stderr", false, `
+	Print the total count of the selected lines, or of the matches if
+	counted, to standard error after the search. With the -q, all the
+	files are still searched to count them.`)
+
+	flag.BoolVar(&Flags.CountTotal, "count-total", false, `
+	Like the -c, and print a final line with the total of the counts of
+	all input files, labelled (total).`)
+
+	flag.BoolVar(&Flags.Dereference, "R", false, `
+	Read all files under each directory, recursively. Follow all
+	symbolic links, unlike -r.`)
+
+	flag.Var(&Flags.Devices, "devices", `
+	Read or skip the devices, FIFOs and sockets, one of read or skip. By
+	default, they are read if named and skipped if found under the
+	directories, as reading them may block.`)
+
+	flag.Var(&Flags.Devices, "D", `
+	Same as the --devices.`)
+
+	flag.Var(&Flags.Encoding, "encoding", `
+	Transcode the input from NAME to UTF-8 before searching, one of auto,
+	utf-8, latin1, utf-16, utf-16le or utf-16be. The invalid sequences are
+	replaced by U+FFFD. The utf-16 is big endian unless its byte order
+	mark tells otherwise. The auto transcodes each file from the UTF-8,
+	UTF-16 or UTF-32 of its byte order mark, searching the files without
+	one as is. By default the input is searched as is.`)
+
+	flag.Var(&Flags.Exclude, "exclude", `
+	Skip files whose base name matches GLOB when searching recursively.
+	May be repeated. Takes precedence over --include.`)
+
+	flag.Var(&Flags.ExcludeDir, "exclude-dir", `
+	Skip directories whose base name matches GLOB when searching
+	recursively. May be repeated.`)
+
+	flag.Var(exclusiveFlag{&Flags.ExtendedRegexp, &Flags.BasicRegexp}, "E", `
+	Interpret the pattern as an extended regular expression, the default.
+	The last one of -E and -G given wins.`)
+
+	flag.StringVar(&Flags.FilesFrom, "files-from", "", `
+	Search also the files listed in FILE, one per line, or terminated by
+	zero bytes with the -z. The names are not globbed, empty lines are
+	skipped. If FILE is -, read the list from the standard input.`)
 
 	flag.BoolVar(&Flags.FilesWithMatch, "l", false, `
 	Suppress normal output; instead print the name of each input file from
 	which output would normally have been printed. The scanning will stop
-	on the first match.`)
+	on the first match. With the -c, print the counts of only the files
+	with a match instead, scanning them whole. With the -v, print the files
+	with any line not matching.`)
 
 	flag.BoolVar(&Flags.FilesWithoutMatch, "L", false, `
 	Suppress normal output; instead print the name of each input file from
 	which no output would normally have been printed. The scanning will
-	stop on the first match.`)
+	stop on the first match. With the -v, print the files whose lines all
+	match, unlike the -l.`)
+
+	flag.BoolVar(&Flags.FixedStrings, "F", false, `
+	Interpret the pattern as a fixed string, not a regular expression.`)
+
+	flag.BoolVar(&Flags.Follow, "follow", false, `
+	Keep searching the lines appended to the file at its end, like the
+	tail -f, until interrupted or the --timeout. The file truncated is
+	searched again from its beginning, the file renamed is followed by
+	its name. Only one file is followed, the output is line buffered.`)
+
+	flag.Var(exclusiveFlag{&Flags.FullPath, &Flags.Basename}, "full-path", `
+	Print the absolute path of the files. The last one of --basename and
+	--full-path given wins.`)
+
+	flag.BoolVar(&Flags.Gitignore, "gitignore", false, `
+	Skip the files and directories found under the directories that are
+	ignored by the .gitignore files found there, and the .git
+	directories. The *, ** and character classes, the ! and the trailing
+	/ are matched as by git. The .gitignore files of the directories
+	above, the .git/info/exclude and the global excludes are not read, nor
+	those above the directories linked followed by the -R.`)
+
+	flag.StringVar(&Flags.GroupSeparator, "group-separator", "", `
+	Use SEP instead of -- as the line between contiguous groups of
+	matches with context.`)
+
+	flag.StringVar(&Flags.FieldSeparator, "field-separator", "", `
+	Use STR instead of : after the file name, line number, column and byte
+	offset of the selected lines and the counts, as for the file names
+	containing a colon. The - of the context lines is kept.`)
+
+	flag.BoolVar(&Flags.NoGroupSeparator, "no-group-separator", false, `
+	Print no line between contiguous groups of matches with context.`)
+
+	flag.BoolVar(&Flags.FileBoundaries, "context-around-file-boundaries", false, `
+	Print an empty line between the groups of matches with context of
+	different files, keeping the group separator for the groups within a
+	file, so the files stand apart.`)
+
+	flag.BoolVar(&Flags.Gzip, "gzip", false, `
+	Decompress the gzip compressed input files, recognized by the .gz
+	extension or the content.`)
+
+	flag.BoolVar(&Flags.Heading, "heading", false, `
+	Print the file name once, on its own line above the lines of the file,
+	instead of before each of them. The files are separated by an empty
+	line, not by the group separator.`)
+
+	flag.BoolVar(&Flags.Hidden, "hidden", false, `
+	Search the hidden files and directories, whose name starts with a dot,
+	found under the directories too. They are skipped by default, unless
+	named on the command line.`)
+
+	flag.BoolVar(&Flags.IgnoreCase, "i", false, `
+	Ignore case distinctions in both the pattern and the input files.`)
+
+	flag.Var(&Flags.Include, "include", `
+	Search only files whose base name matches GLOB when searching
+	recursively. May be repeated to search files matching any of them.`)
+
+	flag.BoolVar(&Flags.IncludeZero, "include-zero", false, `
+	With the -c, print the count of the files without any selected line
+	too, 0.`)
+
+	flag.BoolVar(&Flags.InitialTab, "T", false, `
+	Align the text of the lines on a tab stop, by a tab after their
+	prefixes. The line numbers, columns and byte offsets are padded to
+	four characters.`)
+
+	flag.BoolVar(&Flags.InitialTab, "initial-tab", false, `
+	Same as the -T.`)
+
+	flag.Var(exclusiveFlag{&Flags.SkipBinary, &Flags.Text}, "I", `
+	Process a binary file as if it did not contain matching data. A file
+	is binary if there is a zero byte in its beginning. The last one of
+	-a and -I given wins.`)
 
 	flag.BoolVar(&Flags.Invert, "v", false, `
 	Invert the sense of matching, to select non-matching lines.`)
 
+	flag.IntVar(&Flags.Jobs, "j", 1, `
+	Search up to NUM files at once. The output of the files is the same as
+	if searched one by one. Zero means the number of CPUs.`)
+
+	flag.IntVar(&Flags.Jobs, "jobs", 1, `
+	Same as the -j.`)
+
+	flag.BoolVar(&Flags.JSON, "json", false, `
+	Print each match of the selected lines as a JSON object on its own
+	line, with the file, line, column, text of the line and match fields.
+	No context lines are printed, the -o is ignored. The counts of the -c
+	are printed as objects with the file and count fields, the total of the
+	--count-total without the file, the names of the -l or -L as objects
+	with the file field, and the binary files matching as objects with the
+	file and binary fields.`)
+
+	flag.StringVar(&Flags.Label, "label", "", `
+	Use LABEL as the name of the standard input in the output, instead
+	of (standard input).`)
+
+	flag.BoolVar(&Flags.LineBuffered, "line-buffered", false, `
+	Flush the output after each line, not only once the buffer is full.
+	Useful when the output is watched while the input is still read.`)
+
+	flag.Var(&Flags.LineTerminator, "line-terminator", `
+	Treat input and output data as sequences of lines, each terminated by
+	CHAR instead of a newline. The CHAR is a single byte, or its escape
+	like \x1e. Takes precedence over the -z.`)
+
+	flag.BoolVar(&Flags.LineMatch, "x", false, `
+	Select only those matches that exactly match the whole line.`)
+
 	flag.BoolVar(&Flags.LineNumbers, "n", false, `
 	Prefix each line of output with the line number within its input
 	file.`)
 
+	flag.IntVar(&Flags.MaxCount, "m", 0, `
+	Stop reading a file after NUM selected lines, printing any trailing
+	context. With the -v, stop after NUM non-matching lines. Zero means
+	no limit.`)
+
+	flag.Var(&Flags.MaxDepth, "max-depth", `
+	Descend at most NUM levels of directories below the directories
+	searched recursively. Zero means only the files directly in them.`)
+
+	flag.Var(&Flags.MaxFilesize, "max-filesize", `
+	Skip files larger than SIZE bytes, telling so unless -s. The SIZE may
+	have a K, M, G or T suffix for the powers of 1024. Zero means no
+	limit.`)
+
+	flag.IntVar(&Flags.MaxLineLength, "max-line-length", 0, `
+	Skip the lines longer than NUM bytes, telling so unless -s, without
+	reading them whole into the memory. Zero means no limit.`)
+
+	flag.BoolVar(&Flags.Mmap, "mmap", false, `
+	Memory map the regular files, not compressed by the --gzip nor
+	transcoded by the --encoding, and scan their content in memory
+	instead of reading them. Other input, or if the mapping fails, is
+	read.`)
+
+	flag.BoolVar(&Flags.Multiline, "multiline", false, `
+	Match the pattern against the whole content of the files, so a match
+	may span lines. The . matches a newline as well, the ^ and $ match at
+	the beginning and end of each line. The lines spanned by each match are
+	printed at once, numbered by the first one. The files are read into the
+	memory whole, limited by the --max-filesize, and searched as they are,
+	as with the -U. Not supported with the -v, the context lines, the
+	--passthru or the --rewrite.`)
+
 	flag.BoolVar(&Flags.NoErrorMessages, "s", false, `
 	Suppress error messages about nonexistent or unreadable files.`)
 
-	flag.BoolVar(&Flags.NoFilename, "h", false, `
+	flag.Var(exclusiveFlag{&Flags.NoFilename, &Flags.WithFilename}, "h", `
 	Suppress the prefixing of filenames on output when multiple files are
-	searched.`)
+	searched. The last one of -h and -H given wins.`)
+
+	flag.BoolVar(&Flags.NullData, "z", false, `
+	Treat input and output data as sequences of lines, each terminated by
+	a zero byte instead of a newline.`)
+
+	flag.BoolVar(&Flags.NullName, "Z", false, `
+	Output a zero byte instead of the character that normally follows a
+	file name. With the -o, terminate each part printed by a zero byte
+	too, instead of a newline, so the parts spanning lines are told apart.`)
+
+	flag.BoolVar(&Flags.NullName, "null", false, `
+	Same as the -Z.`)
+
+	flag.BoolVar(&Flags.OnlyMatching, "o", false, `
+	Print only the matched non-empty parts of matching lines, with each
+	such part on a separate output line. No context lines are printed.
+	Unlike GNU grep, with the -v print the non-empty parts of the lines
+	not matching instead, the gaps between the matches. The lines with
+	any such part are selected then.`)
+
+	flag.IntVar(&Flags.OnlyGroup, "only", 0, `
+	With the -o, print only the capture group N of each match, skipping
+	the matches it did not participate in. Zero means the whole match.`)
+
+	flag.BoolVar(&Flags.Passthru, "passthru", false, `
+	Print all lines, the lines not selected as context lines, so the -n
+	tells the matching ones apart by the separator. With the --color,
+	highlight the matches or, with the -v, the parts not matching. Ignored
+	with the -o, --json and the options printing no lines.`)
+
+	flag.BoolVar(&Flags.Perl, "P", false, `
+	Interpret the pattern as a Perl-compatible regular expression. Needs
+	such an engine built in.`)
+
+	flag.BoolVar(&Flags.Posix, "posix", false, `
+	Match the leftmost-longest text, as POSIX does, instead of the leftmost
+	one the first alternative matches. Changes the parts printed by the -o.
+	Not supported with the -P.`)
 
 	flag.BoolVar(&Flags.Quiet, "q", false, `
 	Quiet; do not write anything to standard output. Exit immediately with
-	zero status if any match is found, even if an error was detected.`)
+	zero status if any match is found, even if an error was detected. The
+	errors are still written to standard error, unless the -s.`)
+
+	flag.BoolVar(&Flags.Recursive, "r", false, `
+	Read all files under each directory, recursively. Symbolic links
+	are followed only if they are on the command line.`)
+
+	flag.BoolVar(&Flags.TextOnly, "text-only", false, `
+	Skip the files found under the directories whose content is not text,
+	like images or executables, as sniffed from its beginning. With the
+	--gzip, the compressed files are searched.`)
+
+	flag.StringVar(&Flags.Replace, "replace", "", `
+	Print the matching lines with each match replaced by TEMPLATE or, with
+	the -o, only the replaced matches. The $1 or ${name} in TEMPLATE refers
+	to a capture group of the match, $0 to the whole match and $$ is a $.
+	The --only is ignored. The files are not modified.`)
+
+	flag.StringVar(&Flags.Rewrite, "rewrite", "", `
+	Rewrite the files with each match replaced by TEMPLATE, as by the
+	--replace, and print the rewritten lines. The old content is kept in
+	the file with the .bak suffix, unless --confirm. The files are replaced
+	at once, keeping their mode and owner if possible. The binary files
+	are skipped. Not supported for the standard input, with the -v, --gzip
+	or --encoding.`)
+
+	flag.BoolVar(&Flags.SortReverse, "reverse", false, `
+	Reverse the order of the --sort.`)
+
+	flag.Var(&Flags.Sort, "sort", `
+	Search the files in the order of their name, size or mtime, the
+	modification time, instead of the order given or found. The files are
+	collected before searching any.`)
+
+	flag.BoolVar(&Flags.Stats, "stats", false, `
+	Print to the standard error, once the search is done, the number of
+	the files searched, the files with a selected line, the selected lines,
+	the matches in them and the time elapsed. Printed with the -q as well.`)
+
+	flag.Var(exclusiveFlag{&Flags.WithFilename, &Flags.NoFilename}, "H", `
+	Print the file name for each match, even if there is only one file to
+	search. The last one of -h and -H given wins.`)
+
+	flag.DurationVar(&Flags.Timeout, "timeout", 0, `
+	Stop searching a file after DURATION, like 10s, telling so unless -s,
+	and go on with the next one. The lines found before are printed. The
+	time is checked between the lines, a line being read is not cut off.
+	Zero means no limit.`)
+
+	flag.IntVar(&Flags.TotalMax, "total-max", 0, `
+	Stop the search after NUM selected lines in all the files, printing any
+	trailing context, unlike the -m per file. The files are searched by one
+	job. Zero means no limit.`)
+
+	flag.BoolVar(&Flags.Truncate, "truncate", false, `
+	With the --max-line-length, truncate the longer lines to NUM bytes
+	and search them instead of skipping them.`)
+
+	flag.BoolVar(&Flags.Unique, "unique", false, `
+	With the -o, print each distinct part of the lines of a file only
+	once, the first one. The distinct parts are kept in the memory until
+	the end of the file.`)
+
+	flag.BoolVar(&Flags.UniqueGlobal, "unique-global", false, `
+	Like the --unique, but print each distinct part only once in all the
+	files, kept in the memory until the end of the search. The files are
+	searched by one job.`)
+
+	flag.BoolVar(&Flags.WordMatch, "w", false, `
+	Select only those lines containing matches that form whole words. The
+	matching substring must be at the beginning or end of the line or
+	surrounded by non-word constituent characters. The side of a pattern
+	anchored by the ^ or $ is bounded by the anchor only, so the ^-foo
+	selects the lines beginning with -foo.`)
 
 }
 
@@ -76,12 +526,43 @@ func cmdMain() (exitCode int) {
 	var cpuprofile = flag.String("cpuprofile", "", `
 	Write CPU profile to this file.`)
 
+	var output = flag.String("output", "", `
+	Write the output to FILE instead of the standard output, creating or
+	truncating it. The - is the standard output. The FILE is not searched,
+	nor truncated if it is one of the files given.`)
+
+	var patternNull = flag.Bool("pattern-null", false, `
+	Separate the patterns of the files of the -f by a zero byte instead of
+	a newline, so a pattern may contain newlines. Such a pattern matches
+	only with the -z or --multiline, as the lines contain no newline.`)
+
+	var patternCheck = flag.Bool("pattern-check", false, `
+	Only check the pattern as modified by the flags, printing OK or the
+	error, and exit. No files are searched.`)
+
+	var patterns stringList
+	flag.Var(&patterns, "e", `
+	Use PATTERN as the pattern. May be repeated to search for lines
+	matching any of them. The first argument is then a path.`)
+
+	var patternFiles stringList
+	flag.Var(&patternFiles, "f", `
+	Obtain patterns from FILE, one per line. May be repeated and combined
+	with the -e. An empty line matches all lines. The first argument is
+	then a path.`)
+
 	flag.Usage = func() {
-		fmt.Fprintln(stderr, "usage: grep [flags] pattern [path ...]")
+		fmt.Fprintln(os.Stderr, "usage: grep [flags] pattern [path ...]")
+		fmt.Fprintln(os.Stderr, "       grep [flags] -e pattern ... [path ...]")
 		flag.PrintDefaults()
 		os.Exit(2)
 	}
-	flag.Parse()
+	flag.CommandLine.Parse(splitShortFlags(flag.CommandLine, os.Args[1:]))
+
+	// Unlike in the Options, where zero is one job.
+	if Flags.Jobs == 0 {
+		Flags.Jobs = runtime.NumCPU()
+	}
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -94,54 +575,363 @@ func cmdMain() (exitCode int) {
 		defer pprof.StopCPUProfile()
 	}
 
-	if flag.NArg() == 0 {
-		flag.Usage()
+	args := flag.Args()
+	if len(patterns) == 0 && len(patternFiles) == 0 {
+		if len(args) == 0 {
+			flag.Usage()
+		}
+		patterns, args = args[:1], args[1:]
+	}
+
+	// The patterns given are newline separated, unlike those of the files
+	// with the --pattern-null.
+	var split []string
+	for _, p := range patterns {
+		split = append(split, strings.Split(p, "\n")...)
+	}
+	patterns = split
+	for _, name := range patternFiles {
+		p, err := readPatterns(name, *patternNull)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "grep: %s\n", err)
+			return 2
+		}
+		patterns = append(patterns, p...)
+	}
+
+	if *patternCheck {
+		return checkPattern(patterns, Flags, os.Stdout, os.Stderr)
 	}
 
-	if Grep(flag.Args()[0], flag.Args()[1:]) {
+	// Ctrl-C stops the search, the output so far is still written.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	ignoreSigpipe()
+
+	g := NewGrepper(Flags)
+	g.Colors = os.Getenv("GREP_COLORS")
+
+	if *output != "" && *output != "-" {
+		f, err := createOutput(*output, args)
+		if err != nil {
+			if !Flags.NoErrorMessages {
+				fmt.Fprintf(os.Stderr, "grep: %s\n", err)
+			}
+			return 2
+		}
+		defer func() {
+			if err := f.Close(); err != nil && exitCode != 2 {
+				if !Flags.NoErrorMessages {
+					fmt.Fprintf(os.Stderr, "grep: %s\n", err)
+				}
+				exitCode = 2
+			}
+		}()
+		g.Stdout = f
+	}
+
+	return run(ctx, g, patterns, args)
+}
+
+// run searches by the Grepper, printing the error if any. Returns the exit
+// code as GNU grep, 0 if any line is selected, 1 if none, 2 if an error
+// occurred, even with a line selected unless -q, or 130 as of SIGINT if the
+// ctx is canceled.
+func run(ctx context.Context, g *Grepper, patterns []string, globs []string) int {
+	q, err := CompilePatterns(patterns, g.Options)
+	if err != nil {
+		fmt.Fprintln(g.Stderr, err)
+		return 2
+	}
+
+	match, err := g.SearchQuery(ctx, q, globs)
+	if ctx.Err() != nil {
+		return 130
+	}
+	if errors.Is(err, errWrite) && isBrokenPipe(err) {
+		// Like other tools, the reader of the output may stop early,
+		// as the head does.
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(g.Stderr, err)
+		return 2
+	}
+
+	// An error of a file fails the search even if others match, unless
+	// the -q found a match.
+	switch {
+	case g.Failed() && !(g.Quiet && match):
+		return 2
+	case match:
 		return 0
 	}
+	return 1
+}
 
-	return 2
+// createOutput creates or truncates the named output file, unless it is one
+// of the files of the globs, which would be emptied before being searched.
+func createOutput(name string, globs []string) (*os.File, error) {
+	if fi, err := os.Stat(name); err == nil {
+		for _, glob := range globs {
+			paths, _ := expandGlob(glob)
+			for _, path := range paths {
+				if in, err := os.Stat(path); err == nil && os.SameFile(in, fi) {
+					return nil, fmt.Errorf("%s: input file is also the output", path)
+				}
+			}
+		}
+	}
+	return os.Create(name)
 }
 
-// Grep searches the input files, or standard input if no files, for lines
-// containing a match to the given pattern. By default, grep prints the
-// matching lines. Returns true if any match; false otherwise.
-//
-func Grep(pattern string, globs []string) bool {
-	re, err := regexp.Compile(pattern)
+// readPatterns returns the patterns of the named file, one per line or, if
+// null, terminated by a zero byte.
+func readPatterns(name string, null bool) ([]string, error) {
+	f, err := os.Open(name)
 	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	if null {
+		scanner.Split(scanNulls)
+	}
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	return patterns, scanner.Err()
+}
+
+// checkPattern compiles the patterns as for the search with the options,
+// printing OK or the error. Returns the exit code, 0 if the pattern is valid;
+// 2 otherwise.
+func checkPattern(patterns []string, opts Options, stdout, stderr io.Writer) int {
+	if _, err := CompilePatterns(patterns, opts); err != nil {
 		fmt.Fprintln(stderr, err)
-		return false
+		return 2
+	}
+	fmt.Fprintln(stdout, "OK")
+	return 0
+}
+
+// stdinLabel is the default name of the standard input in the output.
+const stdinLabel = "(standard input)"
+
+// stdinName returns the name of the standard input in the output, the Label
+// if set.
+func (g *Grepper) stdinName() string {
+	if g.Label != "" {
+		return g.Label
+	}
+	return stdinLabel
+}
+
+// Grepper searches files for lines matching a pattern. Distinct Greppers
+// can search concurrently, a Grepper itself can run one search at a time.
+type Grepper struct {
+	Options
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Formatter formats the output written to the Stdout, by the options
+	// if nil.
+	Formatter Formatter
+
+	// Predicate selects the lines further among those matching the
+	// pattern, or all the lines with the empty pattern. Called by several
+	// jobs at once with the -j.
+	Predicate Predicate
+
+	// The state of the search in progress.
+	stdout    io.Writer
+	stderr    io.Writer
+	format    Formatter // of the output
+	colorize  bool      // highlight the matches
+	colors    colors    // of the highlighted elements, if colorize
+	grouped   bool      // a group of lines with context was already printed
+	headed    bool      // a heading of a file was already printed
+	printName bool
+	failed    bool            // an error was printed
+	counts    Counter         // of all the files
+	pool      *pool           // searching the files if several jobs
+	searched  map[string]bool // the cleaned names of the files searched
+	collect   bool            // the files to be sorted instead of searched
+	collected []sortedFile
+	printed   map[string]bool // the parts printed by the --unique-global
+	output    os.FileInfo     // of the Stdout if a regular file, not searched
+
+	ctx     context.Context // stopping the search if canceled
+	results chan<- Result   // the lines are sent to, by the SearchStream
+}
+
+// NewGrepper returns a Grepper with the options, reading the standard input
+// and writing to the standard output and error.
+func NewGrepper(opts Options) *Grepper {
+	return &Grepper{
+		Options: opts,
+		Stdin:   os.Stdin,
+		Stdout:  os.Stdout,
+		Stderr:  os.Stderr,
+	}
+}
+
+// Grep searches like the Grepper with the options set by the command line
+// flags.
+func Grep(pattern string, globs []string) (bool, error) {
+	return GrepContext(context.Background(), pattern, globs)
+}
+
+// GrepContext is like the Grep, but stops searching once the ctx is canceled.
+func GrepContext(ctx context.Context, pattern string, globs []string) (bool, error) {
+	g := NewGrepper(Flags)
+	g.Colors = os.Getenv("GREP_COLORS")
+	return g.SearchContext(ctx, pattern, globs)
+}
+
+// Search searches the input files, or standard input if no files, for lines
+// containing a match to the given pattern. The pattern may contain several
+// newline separated patterns, a line matching any of them is selected. By
+// default, grep prints the matching lines. Returns true if any match; false
+// otherwise. The error is returned for an invalid pattern, failed reading
+// of the standard input or failed writing to the Stdout, which stops the
+// search. The errors of the files are printed and the search continues.
+func (g *Grepper) Search(pattern string, globs []string) (bool, error) {
+	return g.SearchContext(context.Background(), pattern, globs)
+}
+
+// SearchContext is like the Search, but stops searching once the ctx is
+// canceled, even in the middle of a file. The output so far is written and
+// the error of the ctx returned.
+func (g *Grepper) SearchContext(ctx context.Context, pattern string, globs []string) (bool, error) {
+	q, err := Compile(pattern, g.Options)
+	if err != nil {
+		return false, err
+	}
+	return g.SearchQuery(ctx, q, globs)
+}
+
+// search searches the input files, or standard input if no files, for lines
+// matching the compiled pattern, see the Search.
+func (g *Grepper) search(re Matcher, globs []string) (match bool, err error) {
+	if err := g.checkRewrite(globs); err != nil {
+		return false, err
+	}
+	if err := g.checkMultiline(); err != nil {
+		return false, err
+	}
+	if err := g.checkFollow(globs); err != nil {
+		return false, err
+	}
+
+	var names []string
+	if g.FilesFrom != "" {
+		var err error
+		names, err = g.readFiles(g.FilesFrom)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// Important! Output can be suppressed after compiling pattern, its
+	// error if any is shown by the caller.
+	g.stdout, g.stderr = g.Stdout, g.Stderr
+	if g.Quiet {
+		g.stdout = ioutil.Discard
+	}
+
+	if g.CountToStderr {
+		defer func() { fmt.Fprintln(g.Stderr, g.count(g.counts)) }()
+	}
+
+	if g.Stats {
+		start := time.Now()
+		defer func() { g.printStats(time.Since(start)) }()
+	}
+
+	g.colorize = g.Color.enabled(g.stdout)
+	g.colors = colors{}
+	if g.colorize {
+		g.colors = parseColors(g.Colors)
+	}
+
+	// An error writing the output stops the search as if canceled.
+	parent := g.ctx
+	ctx, cancel := context.WithCancel(parent)
+	g.ctx = ctx
+	defer func() {
+		cancel()
+		g.ctx = parent
+	}()
+
+	if !g.Quiet {
+		out := &bufferedWriter{w: bufio.NewWriter(g.stdout), out: g.stdout, line: g.LineBuffered || g.Follow, end: g.outputEnd()[0], stop: cancel}
+		defer func() {
+			out.Flush()
+			if err == nil && out.err != nil {
+				err = fmt.Errorf("%w: %w", errWrite, out.err)
+			}
+		}()
+		g.stdout = out
+	}
+
+	g.format = g.Formatter
+	if g.format == nil {
+		g.format = g.formatter()
+	}
+	g.grouped = false
+	g.counts = Counter{}
+	g.failed = false
+	g.searched = make(map[string]bool)
+	g.collect = g.Sort != ""
+	g.collected = nil
+	g.printed = make(map[string]bool)
+	g.output = nil
+	if f, ok := g.Stdout.(*os.File); ok && !g.Quiet {
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			g.output = fi
+		}
 	}
 
-	// Important! Output can be suppressed after compiling pattern and
-	// showing its error if any.
-	if Flags.Quiet {
-		stderr = ioutil.Discard
-		stdout = ioutil.Discard
-	} else if Flags.NoErrorMessages {
-		stderr = ioutil.Discard
+	if len(globs) == 0 && g.FilesFrom == "" {
+		g.printName = g.WithFilename
+		match, err := g.grepFile(g.stdinName(), g.Stdin, re)
+		g.printTotal()
+		return match, err
 	}
 
-	if len(globs) == 0 {
-		return grepFile("", stdin, re)
+	// With the -q, the files are searched sequentially to stop at the
+	// first match, with the --unique-global to print the first parts and
+	// with the --total-max to stop at the last line. The Formatter writes
+	// where it does, not to the output of the file searched. The file
+	// followed is never done.
+	if g.jobs() > 1 && !g.Quiet && !g.UniqueGlobal && g.TotalMax == 0 && g.Formatter == nil && !g.Follow {
+		g.startPool(re)
 	}
 
 	matchFiles := 0
 
 	for _, glob := range globs {
-		paths, err := filepath.Glob(glob)
+		if g.canceled() || g.quitting() && matchFiles > 0 || g.totalMaxed() {
+			break
+		}
+
+		paths, err := expandGlob(glob)
 		if err != nil {
-			fmt.Fprintf(stderr, "grep: %s: %s\n", glob, err)
+			g.errorf("grep: %s: %s\n", glob, err)
 			continue
 		}
 
 		// It's hard to predict if there are multiple files. Note That
 		// for multiple files is file name printed, if not prevented by
-		// Flags.NoFilename.
-		printName = !Flags.NoFilename && (len(globs) > 1 || len(paths) > 1)
+		// NoFilename, or always if WithFilename.
+		g.printName = g.WithFilename ||
+			!g.NoFilename && (len(globs)+len(names) > 1 || len(paths) > 1)
 
 		if len(paths) == 0 {
 			// This glob pattern has no matching file. Adding glob
@@ -151,86 +941,1463 @@ func Grep(pattern string, globs []string) bool {
 		}
 
 		for _, name := range paths {
-			f, err := os.Open(name)
-			if err != nil {
-				fmt.Fprintf(stderr, "grep: %s: %s\n", name, err)
-				continue
+			if g.totalMaxed() {
+				break
+			}
+			if g.grepPath(name, re) {
+				matchFiles++
+				if g.quitting() {
+					break
+				}
 			}
-			defer f.Close()
+		}
+	}
+
+	g.printName = g.WithFilename || !g.NoFilename && len(globs)+len(names) > 1
+	for _, name := range names {
+		if g.canceled() || g.quitting() && matchFiles > 0 || g.totalMaxed() {
+			break
+		}
+		if g.grepPath(name, re) {
+			matchFiles++
+		}
+	}
+
+	if g.collect {
+		g.collect = false
+		sortFiles(g.collected, g.Sort, g.SortReverse)
 
-			if grepFile(name, f, re) {
+		for _, f := range g.collected {
+			if g.canceled() || g.quitting() && matchFiles > 0 || g.totalMaxed() {
+				break
+			}
+			g.printName = f.printName
+			if g.grepName(f.name, re) {
 				matchFiles++
 			}
 		}
 	}
 
-	return matchFiles > 0
+	if g.pool != nil && g.stopPool() {
+		matchFiles++
+	}
+
+	g.printTotal()
+
+	return matchFiles > 0, nil
 }
 
-func grepFile(name string, in io.Reader, pattern *regexp.Regexp) bool {
+// readFiles returns the file names listed in the named file, or in the
+// standard input if the name is -. The names are separated by newlines or, if
+// NullData, by zero bytes. The empty names are skipped.
+func (g *Grepper) readFiles(name string) ([]string, error) {
+	in := g.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+
 	scanner := bufio.NewScanner(in)
-	lineNumber := 0
-	count := 0
+	if g.NullData {
+		scanner.Split(scanNulls)
+	}
 
+	var names []string
 	for scanner.Scan() {
-		line := scanner.Text()
-		lineNumber++
-
-		if pattern.MatchString(line) == Flags.Invert {
-			continue
+		if scanner.Text() != "" {
+			names = append(names, scanner.Text())
 		}
+	}
+	return names, scanner.Err()
+}
+
+// grepPath searches the named file, or the files under the named directory
+// if recursive. Returns true if any match; false otherwise.
+func (g *Grepper) grepPath(name string, re Matcher) bool {
+	if name == "-" {
+		return g.grepName(name, re)
+	}
 
-		if Flags.FilesWithoutMatch {
+	fi, err := os.Stat(name)
+	if err != nil {
+		g.openErrorf("grep: %s: %s\n", name, err)
+		return false
+	}
+
+	if !fi.IsDir() {
+		if g.Devices == "skip" && isDevice(fi.Mode()) || g.repeated(name) {
 			return false
 		}
+		return g.grepName(name, re)
+	}
 
-		if Flags.Quiet {
-			return true
-		}
+	if !g.Recursive && !g.Dereference {
+		g.openErrorf("grep: %s: Is a directory\n", name)
+		return false
+	}
 
-		if Flags.FilesWithMatch {
-			if printName {
-				fmt.Fprintln(stdout, name)
-			}
-			return true
+	return g.grepDir(name, re)
+}
+
+// repeated reports whether the named file was already searched, given
+// again by another path argument, or found under another directory.
+func (g *Grepper) repeated(name string) bool {
+	name = filepath.Clean(name)
+	if g.searched[name] {
+		return true
+	}
+	g.searched[name] = true
+	return false
+}
+
+// grepName searches the named file, or the standard input if the name is -.
+// With a pool of workers, the file is queued and its match is reported by the
+// pool instead. With the --sort, the file is collected to be searched later.
+// Returns true if any match; false otherwise.
+func (g *Grepper) grepName(name string, re Matcher) bool {
+	if g.collect {
+		g.collectFile(name)
+		return false
+	}
+
+	if g.pool != nil {
+		g.pool.add(g, name)
+		return false
+	}
+
+	if g.Rewrite != "" {
+		return g.rewriteFile(name, re)
+	}
+
+	if name == "-" {
+		match, err := g.grepFile(g.stdinName(), g.Stdin, re)
+		if err != nil {
+			g.errorf("grep: %s: %s\n", g.stdinName(), err)
 		}
+		return match
+	}
 
-		count++
+	f, err := os.Open(name)
+	if err != nil {
+		g.openErrorf("grep: %s: %s\n", name, err)
+		return false
+	}
+	defer f.Close()
 
-		if Flags.CountOnly {
-			continue
+	if fi, err := f.Stat(); err == nil {
+		// The output written while searching the file would be
+		// searched again, without end.
+		if g.output != nil && os.SameFile(fi, g.output) {
+			g.openErrorf("grep: %s: input file is also the output\n", name)
+			return false
+		}
+		if g.tooLarge(name, fi.Size()) {
+			return false
 		}
+	}
 
-		if printName {
-			fmt.Fprint(stdout, name)
-			fmt.Fprint(stdout, ":")
+	if g.Follow {
+		match, err := g.followFile(name, f, re)
+		if err != nil {
+			g.errorf("grep: %s: %s\n", name, err)
 		}
+		return match
+	}
 
-		if Flags.LineNumbers {
-			fmt.Fprint(stdout, lineNumber)
-			fmt.Fprint(stdout, ":")
+	if g.Mmap && !g.Gzip && g.Encoding == "" {
+		if data, err := mmapFile(f); err == nil {
+			defer munmap(data)
+
+			match, err := g.grepData(g.displayName(name), data, re)
+			if err != nil {
+				g.errorf("grep: %s: %s\n", name, err)
+			}
+			return match
 		}
+	}
 
-		fmt.Fprintln(stdout, line)
+	var in io.Reader = f
+	if g.Gzip {
+		in, err = decompress(name, f)
+		if err != nil {
+			g.errorf("grep: %s: %s\n", name, err)
+			return false
+		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(stderr, err)
+	match, err := g.grepFile(g.displayName(name), in, re)
+	if err != nil {
+		g.errorf("grep: %s: %s\n", name, err)
 	}
+	return match
+}
 
-	if Flags.FilesWithoutMatch {
-		if printName {
-			fmt.Fprintln(stdout, name)
-		}
-	} else if Flags.CountOnly {
-		if count > 0 {
-			if printName {
-				fmt.Fprint(stdout, name)
-				fmt.Fprint(stdout, ":")
-			}
-			fmt.Fprintln(stdout, count)
+// displayName returns the name of the file as printed, the base name by the
+// Basename or the absolute path by the FullPath.
+func (g *Grepper) displayName(name string) string {
+	switch {
+	case g.Basename:
+		return filepath.Base(name)
+	case g.FullPath:
+		if abs, err := filepath.Abs(name); err == nil {
+			return abs
 		}
 	}
+	return name
+}
+
+// decompress returns the decompressed content of the named file if it is
+// gzip compressed, by the .gz extension or the magic number of its content.
+// Otherwise returns the content as is.
+func decompress(name string, in io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(in)
+	magic, _ := br.Peek(2)
+	if !strings.HasSuffix(name, ".gz") && !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
+
+// errorf prints the error of searching a file, which does not stop the
+// search. The search failed.
+func (g *Grepper) errorf(format string, a ...interface{}) {
+	fmt.Fprintf(g.stderr, format, a...)
+	g.failed = true
+}
+
+// openErrorf prints the error of a nonexistent or unreadable file, like the
+// errorf, unless NoErrorMessages.
+func (g *Grepper) openErrorf(format string, a ...interface{}) {
+	if !g.NoErrorMessages {
+		g.errorf(format, a...)
+	}
+}
+
+// Failed reports whether an error occurred searching some of the files by
+// the last search, except the suppressed ones of the NoErrorMessages. Such
+// errors are printed, not returned by the Search.
+func (g *Grepper) Failed() bool {
+	return g.failed
+}
+
+// tooLarge reports whether the file of the size is skipped for the
+// --max-filesize, telling so.
+func (g *Grepper) tooLarge(name string, size int64) bool {
+	if g.MaxFilesize == 0 || size <= int64(g.MaxFilesize) {
+		return false
+	}
+	fmt.Fprintf(g.stderr, "grep: %s: skipped, larger than %d bytes\n", name, g.MaxFilesize)
+	return true
+}
+
+// Matcher matches the lines against the pattern. The *regexp.Regexp is the
+// default Matcher.
+type Matcher interface {
+	MatchString(s string) bool
+	FindAllStringIndex(s string, n int) [][]int
+}
+
+// Predicate reports whether the line, without its terminator, is selected.
+// The line must not be retained.
+type Predicate func(line []byte) bool
+
+// byteMatcher is a Matcher matching the bytes as well, like the
+// *regexp.Regexp. Saves converting the lines to strings.
+type byteMatcher interface {
+	Match(b []byte) bool
+}
+
+// matchBytes reports whether the line matches the pattern.
+func matchBytes(pattern Matcher, line []byte) bool {
+	if m, ok := pattern.(byteMatcher); ok {
+		return m.Match(line)
+	}
+	return pattern.MatchString(string(line))
+}
+
+// submatcher is a Matcher finding the capture groups as well, like the
+// *regexp.Regexp. Needed by the --only.
+type submatcher interface {
+	FindAllStringSubmatchIndex(s string, n int) [][]int
+}
+
+// replacer is a Matcher replacing the matches by the template of the
+// --replace, like the *regexp.Regexp.
+type replacer interface {
+	submatcher
+	ReplaceAllString(src, template string) string
+	ExpandString(dst []byte, template string, src string, match []int) []byte
+}
+
+// checkTemplate returns an error if the template of the --replace refers to
+// a capture group not in the re or is malformed.
+func checkTemplate(re *regexp.Regexp, template string) error {
+	for {
+		i := strings.IndexByte(template, '$')
+		if i < 0 {
+			return nil
+		}
+		template = template[i+1:]
+
+		var name string
+		switch {
+		case strings.HasPrefix(template, "$"):
+			template = template[1:]
+			continue
+		case strings.HasPrefix(template, "{"):
+			end := strings.IndexByte(template, '}')
+			if end < 0 {
+				return errors.New("missing } of ${")
+			}
+			name, template = template[1:end], template[end+1:]
+		default:
+			end := strings.IndexFunc(template, func(r rune) bool {
+				return r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+			})
+			if end < 0 {
+				end = len(template)
+			}
+			name, template = template[:end], template[end:]
+		}
+
+		if n, err := strconv.Atoi(name); err == nil && n >= 0 && n <= re.NumSubexp() {
+			continue
+		}
+		if name == "" || re.SubexpIndex(name) < 0 {
+			return fmt.Errorf("no such capture group %q in the pattern", name)
+		}
+	}
+}
+
+// perlCompile compiles the Perl-compatible regular expressions of the -P.
+// There is no such engine built in by default, a file providing it sets
+// this in its init.
+var perlCompile func(expr string) (Matcher, error)
+
+// compilePattern compiles the newline separated patterns modified according
+// to the flags, see the compilePatterns.
+func (g *Grepper) compilePattern(pattern string) (Matcher, error) {
+	return g.compilePatterns(strings.Split(pattern, "\n"))
+}
+
+// compilePatterns compiles the patterns modified according to the flags. The
+// errors are reported for the patterns as given by the user.
+func (g *Grepper) compilePatterns(patterns []string) (Matcher, error) {
+	expr := g.patternExpr(patterns)
+
+	if g.Perl {
+		if g.Posix {
+			return nil, errors.New("--posix is not supported with the -P")
+		}
+		if perlCompile == nil {
+			return nil, errors.New("-P is not supported: no Perl-compatible regular expression engine built in")
+		}
+		m, err := perlCompile(expr)
+		if err == nil && g.OnlyGroup != 0 {
+			if _, ok := m.(submatcher); !ok {
+				return nil, errors.New("--only is not supported by the -P engine")
+			}
+		}
+		if err == nil && (g.Replace != "" || g.Rewrite != "") {
+			if _, ok := m.(replacer); !ok {
+				return nil, errors.New("--replace and --rewrite are not supported by the -P engine")
+			}
+		}
+		return m, err
+	}
+
+	if m := g.fixedMatcher(patterns); m != nil {
+		return m, nil
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		for _, p := range patterns {
+			if _, origErr := regexp.Compile(p); origErr != nil {
+				return nil, origErr
+			}
+		}
+		return nil, err
+	}
+	if g.Posix {
+		re.Longest()
+	}
+	if g.OnlyGroup < 0 || g.OnlyGroup > re.NumSubexp() {
+		return nil, fmt.Errorf("--only=%d: no such capture group in the pattern", g.OnlyGroup)
+	}
+	if err := checkTemplate(re, g.Replace); err != nil {
+		return nil, fmt.Errorf("--replace=%s: %s", g.Replace, err)
+	}
+	if err := checkTemplate(re, g.Rewrite); err != nil {
+		return nil, fmt.Errorf("--rewrite=%s: %s", g.Rewrite, err)
+	}
+	return re, nil
+}
+
+// fixedMatcher returns the Aho-Corasick automaton for many non-empty fixed
+// strings, or nil if they are matched by the regular expression. The flags
+// modifying the matching are left to the regular expression.
+func (g *Grepper) fixedMatcher(patterns []string) Matcher {
+	if !g.FixedStrings || g.Posix || g.IgnoreCase || g.WordMatch || g.LineMatch || g.OnlyGroup != 0 || g.Replace != "" || g.Rewrite != "" {
+		return nil
+	}
+
+	if len(patterns) < ahoCorasickMin {
+		return nil
+	}
+	for _, s := range patterns {
+		if s == "" {
+			return nil
+		}
+	}
+	return newAhoCorasick(patterns)
+}
+
+// patternExpr returns the regular expression matching any of the patterns,
+// modified according to the flags.
+func (g *Grepper) patternExpr(patterns []string) string {
+	exprs := make([]string, len(patterns))
+	for i, p := range patterns {
+		if g.FixedStrings {
+			p = regexp.QuoteMeta(p)
+		} else if g.BasicRegexp {
+			p = translateBRE(p)
+		}
+		if g.WordMatch {
+			p = wordExpr(p)
+		}
+		if len(patterns) > 1 {
+			p = `(?:` + p + `)`
+		}
+		exprs[i] = p
+	}
+
+	expr := strings.Join(exprs, "|")
+	if g.LineMatch {
+		expr = `^(?:` + expr + `)$`
+	}
+	if g.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	if g.Multiline {
+		expr = "(?ms)" + expr
+	}
+	return expr
+}
+
+// wordExpr returns the regular expression matching the expr as whole words,
+// bounded by \b. The side anchored by the ^ or $ of the expr is bounded by
+// it instead, so the ^-foo still matches at the beginning of the line.
+func wordExpr(expr string) string {
+	before, after := `\b`, `\b`
+	if strings.HasPrefix(expr, "^") {
+		before = ""
+	}
+	if trimmed := strings.TrimSuffix(expr, "$"); trimmed != expr {
+		// The \$ matches the dollar sign, not the end.
+		escapes := len(trimmed) - len(strings.TrimRight(trimmed, `\`))
+		if escapes%2 == 0 {
+			after = ""
+		}
+	}
+	return before + `(?:` + expr + `)` + after
+}
+
+func (g *Grepper) grepFile(name string, in io.Reader, pattern Matcher) (bool, error) {
+	if g.Timeout > 0 {
+		in = &deadlineReader{r: in, deadline: time.Now().Add(g.Timeout)}
+	}
+	if g.Encoding != "" {
+		in = g.Encoding.decode(in)
+	}
+
+	if g.Multiline {
+		data, ok, err := g.readAll(name, in)
+		if !ok || err != nil {
+			return false, err
+		}
+		g.counts.Searched++
+		return g.grepMultiline(name, data, pattern)
+	}
+
+	g.counts.Searched++
+	br := bufio.NewReaderSize(in, binaryPeek)
+	head, _ := br.Peek(binaryPeek)
+	return g.grepLines(name, head, g.newLineScanner(br), pattern)
+}
+
+// grepData searches the content of the file in memory, like the grepFile.
+func (g *Grepper) grepData(name string, data []byte, pattern Matcher) (bool, error) {
+	g.counts.Searched++
+	if g.Multiline {
+		return g.grepMultiline(name, data, pattern)
+	}
+
+	head := data
+	if len(head) > binaryPeek {
+		head = head[:binaryPeek]
+	}
+	return g.grepLines(name, head, g.newDataScanner(data), pattern)
+}
+
+// grepLines searches the lines of the scanner, the head is the beginning of
+// the input to detect if it is binary.
+func (g *Grepper) grepLines(name string, head []byte, scanner *lineScanner, pattern Matcher) (bool, error) {
+	binary := g.isBinary(head)
+	if binary && g.SkipBinary {
+		return false, nil
+	}
+
+	lineNumber := 0
+	var counts Counter
+
+	// Line number of the last printed line, the number of trailing
+	// context lines yet to be printed and the not printed lines which may
+	// become leading context.
+	beforeContext, afterContext := g.contextLines()
+	lastPrinted := 0
+	afterLeft := 0
+	before := newRing(beforeContext)
+
+	// Once the -m count is reached only the trailing context is read.
+	maxed := false
+
+	// The search of the file stops once the ctx is done, canceled or
+	// after the Timeout.
+	ctx := g.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if g.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.Timeout)
+		defer cancel()
+	}
+
+	// The lines not selected are printed as well.
+	passthru := g.passthru() && !binary
+
+	// The distinct parts printed by the -o, with the --unique.
+	var printed map[string]bool
+	switch {
+	case g.UniqueGlobal:
+		printed = g.printed
+	case g.Unique:
+		printed = make(map[string]bool)
+	}
+
+	// The lines printed of the file are headed.
+	headed := false
+	printLine := func(line inputLine, sep string) {
+		if !headed {
+			g.format.FileHeader(name)
+			headed = true
+		}
+		g.printLine(name, line, sep)
+	}
+
+	timedOut := func() {
+		if !g.canceled() && !g.NoErrorMessages {
+			fmt.Fprintf(g.stderr, "grep: %s: timed out after %v, the rest is skipped\n", name, g.Timeout)
+		}
+	}
+
+	for (!maxed || afterLeft > 0) && scanner.Scan() {
+		// The deadline of the Timeout is checked on every line, as the
+		// lines may come slowly, the cancel every cancelLines.
+		if (g.Timeout > 0 || lineNumber%cancelLines == 0) && ctx.Err() != nil {
+			timedOut()
+			break
+		}
+		lineNumber++
+
+		if scanner.long {
+			if !g.NoErrorMessages {
+				fmt.Fprintf(g.stderr, "grep: %s:%d: skipped, longer than %d bytes\n", name, lineNumber, g.MaxLineLength)
+			}
+			continue
+		}
+
+		// The line is converted to a string only if needed, most lines
+		// of the large input typically are not.
+		if maxed || !g.selected(pattern, scanner.Bytes()) {
+			if passthru {
+				line := scanner.line(lineNumber)
+				if g.colorize && g.Invert {
+					line.matches = gaps(pattern.FindAllStringIndex(line.text, -1), len(line.text))
+				}
+				printLine(line, "-")
+				lastPrinted = lineNumber
+			} else if afterLeft > 0 {
+				afterLeft--
+				printLine(scanner.line(lineNumber), "-")
+				lastPrinted = lineNumber
+			} else if beforeContext > 0 {
+				before.push(scanner.line(lineNumber))
+			}
+			continue
+		}
+
+		line := scanner.line(lineNumber)
+
+		// With the -c, the -l only omits the files without a match.
+		listing := g.FilesWithMatch && !g.counting()
+
+		if g.FilesWithoutMatch || g.quitting() || listing {
+			g.counts.add(Counter{Lines: 1, Files: 1})
+		}
+
+		if g.FilesWithoutMatch {
+			return false, nil
+		}
+
+		if g.quitting() {
+			return true, nil
+		}
+
+		if listing {
+			g.format.Name(name)
+			return true, nil
+		}
+
+		counts.Lines++
+		if g.countingMatches() || g.Stats && !g.Invert {
+			counts.Matches += countMatches(pattern, line.text)
+			if g.countingMatches() && g.MaxCount > 0 && counts.Matches > g.MaxCount {
+				counts.Matches = g.MaxCount
+			}
+		}
+		maxed = g.MaxCount > 0 && g.count(counts) >= g.MaxCount ||
+			g.TotalMax > 0 && g.counts.Lines+counts.Lines >= g.TotalMax
+
+		if g.counting() {
+			continue
+		}
+
+		// The lines of a binary file are not printed, it may be any
+		// garbage.
+		if binary {
+			g.format.Binary(name)
+			return true, nil
+		}
+
+		if beforeContext > 0 || afterContext > 0 {
+			first := lineNumber - before.len()
+			// With the heading, the files are separated by it.
+			switch {
+			case !g.grouped:
+			case lastPrinted == 0 && !g.heading():
+				g.format.Separator(true)
+			case lastPrinted > 0 && lastPrinted < first-1:
+				g.format.Separator(false)
+			}
+			g.grouped = true
+		}
+
+		for i := 0; i < before.len(); i++ {
+			printLine(before.get(i), "-")
+		}
+		before.reset()
+
+		if g.OnlyMatching && !g.JSON {
+			for _, loc := range g.onlyMatches(pattern, line.text) {
+				if loc[0] < loc[1] {
+					match := inputLine{
+						text:   line.text[loc[0]:loc[1]],
+						number: lineNumber,
+						offset: line.offset + int64(loc[0]),
+						column: g.Column.of(line.text, loc),
+					}
+					if g.Replace != "" && !g.Invert {
+						match.text = string(pattern.(replacer).ExpandString(nil, g.Replace, line.text, loc))
+					}
+					if !g.Invert {
+						match.matches = [][]int{{0, len(match.text)}}
+					}
+					if printed != nil {
+						if printed[match.text] {
+							continue
+						}
+						printed[match.text] = true
+					}
+					printLine(match, ":")
+				}
+			}
+		} else {
+			if (g.colorize || g.results != nil || g.JSON) && !g.Invert {
+				line.matches = pattern.FindAllStringIndex(line.text, -1)
+			} else if passthru && g.colorize {
+				line.matches = gaps(pattern.FindAllStringIndex(line.text, -1), len(line.text))
+			}
+			if g.Column != "" && !g.Invert {
+				if line.matches != nil {
+					line.column = g.Column.of(line.text, line.matches[0])
+				} else if locs := pattern.FindAllStringIndex(line.text, 1); locs != nil {
+					line.column = g.Column.of(line.text, locs[0])
+				}
+			}
+			if g.Replace != "" && !g.Invert && !g.JSON {
+				line.text = pattern.(replacer).ReplaceAllString(line.text, g.Replace)
+				line.matches = nil
+			}
+			printLine(line, ":")
+		}
+		lastPrinted = lineNumber
+		afterLeft = afterContext
+	}
+
+	err := scanner.Err()
+	if errors.Is(err, errTimedOut) {
+		timedOut()
+		err = nil
+	}
+
+	g.endFile(name, counts)
+	return counts.Lines > 0, err
+}
+
+// endFile adds the counts of the searched file to those of all the files,
+// printing its count by the -c or its name by the -L.
+func (g *Grepper) endFile(name string, counts Counter) {
+	if counts.Lines > 0 {
+		counts.Files = 1
+	}
+	g.counts.add(counts)
+
+	if g.FilesWithoutMatch {
+		g.format.Name(name)
+	} else if g.counting() {
+		if count := g.count(counts); count > 0 || g.IncludeZero && !g.FilesWithMatch {
+			g.format.Count(name, count)
+		}
+	}
+}
+
+// binaryPeek is the size of the beginning of the input looked at to detect
+// the binary files.
+const binaryPeek = 32 * 1024
+
+// isBinary reports whether the input is binary, having a zero byte in its
+// beginning, the head. With the NullData, the zero bytes are the line
+// terminators. With the Text, no input is binary.
+func (g *Grepper) isBinary(head []byte) bool {
+	if g.NullData || g.Text || g.LineTerminator == "\x00" {
+		return false
+	}
+	return bytes.IndexByte(head, 0) >= 0
+}
+
+// selected reports whether the line is selected, matching the pattern and the
+// Predicate or, with the -v, not matching them. With both the -o and -v, the
+// lines with any part not matching are selected.
+func (g *Grepper) selected(pattern Matcher, line []byte) bool {
+	if g.Predicate != nil && !g.Predicate(line) {
+		return g.Invert
+	}
+	if g.OnlyMatching && g.Invert {
+		return len(g.onlyMatches(pattern, string(line))) > 0
+	}
+	return matchBytes(pattern, line) != g.Invert
+}
+
+// onlyMatches returns the locations of the parts of the text printed by the
+// -o, the matches or their capture group of the OnlyGroup. With the Replace,
+// the locations of the capture groups follow, for the template. With the -v,
+// the non-empty gaps between them instead.
+func (g *Grepper) onlyMatches(pattern Matcher, text string) [][]int {
+	var locs [][]int
+	switch {
+	case g.Replace != "":
+		locs = pattern.(submatcher).FindAllStringSubmatchIndex(text, -1)
+	case g.OnlyGroup == 0:
+		locs = pattern.FindAllStringIndex(text, -1)
+	default:
+		for _, m := range pattern.(submatcher).FindAllStringSubmatchIndex(text, -1) {
+			if i := 2 * g.OnlyGroup; i+1 < len(m) && m[i] >= 0 {
+				locs = append(locs, m[i:i+2])
+			}
+		}
+	}
+
+	if g.Invert {
+		return gaps(locs, len(text))
+	}
+	return locs
+}
+
+// gaps returns the non-empty parts of the text of the length n between the
+// locations, in order and not overlapping.
+func gaps(locs [][]int, n int) [][]int {
+	var gaps [][]int
+	start := 0
+	for _, loc := range locs {
+		if loc[0] > start {
+			gaps = append(gaps, []int{start, loc[0]})
+		}
+		if loc[1] > start {
+			start = loc[1]
+		}
+	}
+	if n > start {
+		gaps = append(gaps, []int{start, n})
+	}
+	return gaps
+}
+
+// counting reports whether the count of the selected lines, or matches, is
+// printed instead of them.
+func (g *Grepper) counting() bool {
+	return g.CountOnly || g.CountMatches || g.CountTotal
+}
+
+// countMatches returns the number of the non-empty matches in the text.
+func countMatches(pattern Matcher, text string) int {
+	n := 0
+	for _, loc := range pattern.FindAllStringIndex(text, -1) {
+		if loc[0] < loc[1] {
+			n++
+		}
+	}
+	return n
+}
+
+// inputLine is a line read from the input file. With the -o, it is the
+// matching part of the line.
+type inputLine struct {
+	text    string
+	number  int
+	offset  int64
+	matches [][]int // to highlight, if g.colorize or sent
+	column  int     // of the first match, from 1, if the --column
+}
+
+// lineScanner scans the lines of the input, keeping track of their byte
+// offsets. The input is read by the Scanner, or is the data in memory.
+type lineScanner struct {
+	*bufio.Scanner
+	splitLine bufio.SplitFunc
+	offset    int64 // of the current line
+	consumed  int64
+
+	data  []byte // not scanned yet, if no Scanner
+	token []byte // the current line, if no Scanner
+
+	// The lines longer than the maxLength are truncated or, if not
+	// truncate, scanned empty and long.
+	maxLength int
+	truncate  bool
+	term      byte
+	long      bool // the current line is skipped
+	skipping  bool // the rest of a long line, up to the term
+}
+
+func (g *Grepper) newLineScanner(in io.Reader) *lineScanner {
+	s := &lineScanner{Scanner: bufio.NewScanner(in)}
+	g.initScanner(s)
+	s.Split(s.split)
+	// Lines are limited only by the memory, by default the scanner fails
+	// on lines longer than 64KB.
+	s.Buffer(nil, math.MaxInt)
+	return s
+}
+
+// newDataScanner returns a lineScanner of the data in memory.
+func (g *Grepper) newDataScanner(data []byte) *lineScanner {
+	s := &lineScanner{data: data}
+	g.initScanner(s)
+	return s
+}
+
+func (g *Grepper) initScanner(s *lineScanner) {
+	s.splitLine = g.splitLine()
+	s.maxLength = g.MaxLineLength
+	s.truncate = g.Truncate
+	s.term = g.lineEnd()[0]
+}
+
+// splitLine returns the split function of the lines.
+func (g *Grepper) splitLine() bufio.SplitFunc {
+	if g.LineTerminator != "" {
+		term := g.LineTerminator[0]
+		return func(data []byte, atEOF bool) (int, []byte, error) {
+			return scanTerminated(data, atEOF, term)
+		}
+	}
+	if g.NullData {
+		return scanNulls
+	} else if g.Binary {
+		return scanRawLines
+	}
+	return bufio.ScanLines
+}
+
+func (s *lineScanner) Scan() bool {
+	if s.Scanner != nil {
+		return s.Scanner.Scan()
+	}
+
+	if len(s.data) == 0 {
+		return false
+	}
+	// All the data is there, as at the end of the input.
+	advance, token, _ := s.split(s.data, true)
+	s.data = s.data[advance:]
+	s.token = token
+	return token != nil
+}
+
+func (s *lineScanner) Bytes() []byte {
+	if s.Scanner != nil {
+		return s.Scanner.Bytes()
+	}
+	return s.token
+}
+
+func (s *lineScanner) Text() string {
+	return string(s.Bytes())
+}
+
+// line returns the current line, of the number.
+func (s *lineScanner) line(number int) inputLine {
+	return inputLine{text: s.Text(), number: number, offset: s.offset}
+}
+
+func (s *lineScanner) Err() error {
+	if s.Scanner != nil {
+		return s.Scanner.Err()
+	}
+	return nil
+}
+
+func (s *lineScanner) split(data []byte, atEOF bool) (int, []byte, error) {
+	if s.skipping {
+		advance := len(data)
+		if i := bytes.IndexByte(data, s.term); i >= 0 {
+			advance = i + 1
+			s.skipping = false
+		}
+		s.consumed += int64(advance)
+		return advance, nil, nil
+	}
+
+	advance, token, err := s.splitLine(data, atEOF)
+	if token == nil && s.maxLength > 0 && len(data) > s.maxLength {
+		// The long line is not buffered whole, its rest is skipped.
+		advance, token = len(data), data
+		s.skipping = true
+	}
+
+	if token != nil {
+		s.offset = s.consumed
+		s.long = s.maxLength > 0 && len(token) > s.maxLength && !s.truncate
+		switch {
+		case s.long:
+			token = token[:0]
+		case s.maxLength > 0 && len(token) > s.maxLength:
+			token = token[:s.maxLength]
+		}
+	}
+	s.consumed += int64(advance)
+	return advance, token, err
+}
+
+// stringList is a flag.Value collecting the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// terminatorFlag is a flag.Value for the --line-terminator, a single byte
+// given as is or by its escape.
+type terminatorFlag string
+
+func (t *terminatorFlag) String() string {
+	if t == nil || *t == "" {
+		return ""
+	}
+	return strconv.Quote(string(*t))
+}
+
+func (t *terminatorFlag) Set(s string) error {
+	if len(s) != 1 {
+		unquoted, err := strconv.Unquote(`"` + s + `"`)
+		if err != nil || len(unquoted) != 1 {
+			return errors.New("must be a single byte")
+		}
+		s = unquoted
+	}
+	*t = terminatorFlag(s)
+	return nil
+}
+
+// columnFlag is a flag.Value for the --column, the unit of the columns,
+// byte or rune. Given with no value, it is byte.
+type columnFlag string
+
+func (c *columnFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (c *columnFlag) String() string {
+	if c == nil {
+		return ""
+	}
+	return string(*c)
+}
+
+func (c *columnFlag) Set(s string) error {
+	switch s {
+	case "true", "byte":
+		*c = "byte"
+	case "false":
+		*c = ""
+	case "rune":
+		*c = "rune"
+	default:
+		return errors.New("must be byte or rune")
+	}
+	return nil
+}
+
+// of returns the column of the location in the text, from 1, or 0 if no
+// --column.
+func (c columnFlag) of(text string, loc []int) int {
+	switch c {
+	case "byte":
+		return loc[0] + 1
+	case "rune":
+		return utf8.RuneCountInString(text[:loc[0]]) + 1
+	}
+	return 0
+}
+
+// exclusiveFlag is a boolean flag.Value for a pair of mutually exclusive
+// flags, like the -h and -H. Setting one resets the other, so the last one
+// given wins.
+type exclusiveFlag struct {
+	set   *bool
+	reset *bool
+}
+
+func (f exclusiveFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (f exclusiveFlag) String() string {
+	if f.set == nil {
+		return "false"
+	}
+	return strconv.FormatBool(*f.set)
+}
+
+func (f exclusiveFlag) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*f.set = v
+	if v {
+		*f.reset = false
+	}
+	return nil
+}
+
+// splitShortFlags splits the one letter flags combined in an argument, the
+// -rlZ into the -r -l -Z, and the values attached to them, the -C2 into the
+// -C 2, which the flag package does not accept. The arguments from the first
+// one not a flag on are kept as they are.
+func splitShortFlags(fs *flag.FlagSet, args []string) []string {
+	var split []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || len(arg) < 2 || arg[0] != '-' {
+			return append(split, args[i:]...)
+		}
+
+		// The flags of several letters are given as they are, with
+		// their value if not after the =.
+		name := strings.TrimPrefix(arg[1:], "-")
+		if f := fs.Lookup(name); f != nil || strings.Contains(name, "=") || arg[1] == '-' {
+			split = append(split, arg)
+			if f != nil && !isBoolFlag(f) && i+1 < len(args) {
+				i++
+				split = append(split, args[i])
+			}
+			continue
+		}
+
+		var short []string
+		value := false // the next argument is of the last flag
+		for j := 1; j < len(arg); j++ {
+			f := fs.Lookup(arg[j : j+1])
+			if f == nil {
+				// Left to the flag package to report.
+				short, value = []string{arg}, false
+				break
+			}
+			short = append(short, "-"+f.Name)
+			if !isBoolFlag(f) {
+				if j+1 < len(arg) {
+					short = append(short, arg[j+1:])
+				} else {
+					value = true
+				}
+				break
+			}
+		}
+		split = append(split, short...)
+		if value && i+1 < len(args) {
+			i++
+			split = append(split, args[i])
+		}
+	}
+	return split
+}
+
+// isBoolFlag reports whether the flag is given without a value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// byteSize is a flag.Value for a size in bytes, see parseSize.
+type byteSize int64
+
+func (s *byteSize) String() string {
+	if s == nil {
+		return "0"
+	}
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(v string) error {
+	n, err := parseSize(v)
+	if err != nil {
+		return err
+	}
+	*s = byteSize(n)
+	return nil
+}
+
+// parseSize parses the human-readable size, like 10M, into bytes. The K, M,
+// G and T suffixes, of any case, stand for the powers of 1024.
+func parseSize(s string) (int64, error) {
+	num, shift := s, 0
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k', 'K':
+			shift = 10
+		case 'm', 'M':
+			shift = 20
+		case 'g', 'G':
+			shift = 30
+		case 't', 'T':
+			shift = 40
+		}
+		if shift > 0 {
+			num = s[:n-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n << shift, nil
+}
+
+// groupSeparator returns the line between the groups of lines with context,
+// empty if none.
+func (g *Grepper) groupSeparator() string {
+	switch {
+	case g.NoGroupSeparator:
+		return ""
+	case g.GroupSeparator == "":
+		return sgr(g.colors.separator, "--") + "\n"
+	}
+	return sgr(g.colors.separator, g.GroupSeparator) + "\n"
+}
+
+// fileSeparator returns the line between the groups of lines with context of
+// different files, empty if none.
+func (g *Grepper) fileSeparator() string {
+	if g.FileBoundaries {
+		return "\n"
+	}
+	return g.groupSeparator()
+}
+
+// contextLines returns the number of leading and trailing context lines. The
+// -C applies to both unless -B or -A asks for more. There is no context for
+// the -o or --json.
+func (g *Grepper) contextLines() (before, after int) {
+	if g.OnlyMatching || g.JSON {
+		return 0, 0
+	}
+
+	before, after = g.BeforeContext, g.AfterContext
+	if g.Context > before {
+		before = g.Context
+	}
+	if g.Context > after {
+		after = g.Context
+	}
+	return before, after
+}
+
+// totalMaxed reports whether the --total-max count of the selected lines of
+// all the files searched is reached.
+func (g *Grepper) totalMaxed() bool {
+	return g.TotalMax > 0 && g.counts.Lines >= g.TotalMax
+}
+
+// quitting reports whether the search stops at the first selected line, by
+// the -q unless the --count-to-stderr counts all of them.
+func (g *Grepper) quitting() bool {
+	return g.Quiet && !g.CountToStderr
+}
+
+// passthru reports whether all lines are printed, by the --passthru.
+func (g *Grepper) passthru() bool {
+	return g.Passthru && !g.OnlyMatching && !g.JSON && !g.counting() &&
+		!g.FilesWithMatch && !g.FilesWithoutMatch && !g.Quiet
+}
+
+// scanNulls is a bufio.SplitFunc like bufio.ScanLines, but for lines
+// terminated by a zero byte.
+func scanNulls(data []byte, atEOF bool) (int, []byte, error) {
+	return scanTerminated(data, atEOF, 0)
+}
+
+// scanRawLines is a bufio.SplitFunc like bufio.ScanLines, but keeping the
+// carriage return at the end of the lines.
+func scanRawLines(data []byte, atEOF bool) (int, []byte, error) {
+	return scanTerminated(data, atEOF, '\n')
+}
+
+// scanTerminated splits the data to the lines terminated by the term byte.
+func scanTerminated(data []byte, atEOF bool, term byte) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, term); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// lineEnd returns the terminator of the output lines.
+func (g *Grepper) lineEnd() string {
+	if g.LineTerminator != "" {
+		return string(g.LineTerminator)
+	}
+	if g.NullData {
+		return "\x00"
+	}
+	return "\n"
+}
+
+// outputEnd returns the terminator of the lines printed, the lineEnd, but a
+// zero byte for the parts printed by the -o with the NullName.
+func (g *Grepper) outputEnd() string {
+	if g.OnlyMatching && g.NullName {
+		return "\x00"
+	}
+	return g.lineEnd()
+}
+
+// printFilename prints the file name followed by the sep, or by a zero byte
+// if NullName.
+func (g *Grepper) printFilename(name string, sep string) {
+	switch {
+	case g.NullName:
+		sep = "\x00"
+	case sep != "\n":
+		sep = sgr(g.colors.separator, g.field(sep))
+	}
+	fmt.Fprint(g.stdout, sgr(g.colors.filename, name), sep)
+}
+
+// field returns the sep of the prefixes, the ":" replaced by the
+// FieldSeparator if set.
+func (g *Grepper) field(sep string) string {
+	if sep == ":" && g.FieldSeparator != "" {
+		return g.FieldSeparator
+	}
+	return sep
+}
+
+// heading reports whether the lines printed are headed by the name of their
+// file instead of prefixed by it.
+func (g *Grepper) heading() bool {
+	return g.Heading && g.printName && !g.JSON && g.results == nil
+}
+
+// printHeading prints the name of the file on its own line, after an empty
+// line if another file was headed before.
+func (g *Grepper) printHeading(name string) {
+	if g.headed {
+		io.WriteString(g.stdout, g.lineEnd())
+	}
+	g.headed = true
+
+	if g.NullName {
+		fmt.Fprint(g.stdout, sgr(g.colors.filename, name), "\x00")
+		return
+	}
+	fmt.Fprint(g.stdout, sgr(g.colors.filename, name), g.lineEnd())
+}
+
+// printTotal prints the total count of the --count-total.
+func (g *Grepper) printTotal() {
+	if g.CountTotal {
+		g.format.Count(totalName, g.count(g.counts))
+	}
+}
+
+// printStats prints the counts of the search and the time it took to the
+// Stderr, by the --stats.
+func (g *Grepper) printStats(elapsed time.Duration) {
+	fmt.Fprintf(g.Stderr, "%d files searched\n", g.counts.Searched)
+	fmt.Fprintf(g.Stderr, "%d files matched\n", g.counts.Files)
+	fmt.Fprintf(g.Stderr, "%d lines matched\n", g.counts.Lines)
+	fmt.Fprintf(g.Stderr, "%d matches\n", g.counts.Matches)
+	fmt.Fprintf(g.Stderr, "%v elapsed\n", elapsed.Round(time.Microsecond))
+}
+
+// printLine prints the line by the Formatter, or sends it to the results.
+// The sep separates the prefixes, ":" for selected lines and "-" for context
+// lines.
+func (g *Grepper) printLine(name string, line inputLine, sep string) {
+	r := Result{
+		Name:    name,
+		Number:  line.number,
+		Offset:  line.offset,
+		Text:    line.text,
+		Matches: line.matches,
+		Context: sep == "-",
+		Column:  line.column,
+	}
+	if g.results != nil {
+		g.sendResult(r)
+		return
+	}
+	g.format.Line(r)
+}
+
+// bufferedWriter buffers the output. With the line buffering, it is flushed
+// at the end of each line, by a newline or the end byte, together with the
+// underlying writer if that can be flushed as well.
+type bufferedWriter struct {
+	w    *bufio.Writer
+	out  io.Writer
+	line bool
+	end  byte
+
+	err  error  // the first error writing the out
+	stop func() // called once the writing fails
+}
+
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	n, err := b.w.Write(p)
+	if err == nil && b.line && n > 0 && (p[n-1] == '\n' || p[n-1] == b.end || p[n-1] == 0) {
+		err = b.Flush()
+	}
+	return n, b.check(err)
+}
+
+func (b *bufferedWriter) Flush() error {
+	if err := b.w.Flush(); err != nil || !b.line {
+		return b.check(err)
+	}
+	if f, ok := b.out.(interface{ Flush() error }); ok {
+		return b.check(f.Flush())
+	}
+	return nil
+}
+
+// check returns the err, stopping the output if any.
+func (b *bufferedWriter) check(err error) error {
+	if b.err == nil && err != nil {
+		b.err = err
+		if b.stop != nil {
+			b.stop()
+		}
+	}
+	return err
+}
+
+// errTimedOut is the error of reading a file after the Timeout.
+var errTimedOut = errors.New("timed out")
+
+// deadlineReader reads the input until the deadline, the reads after it fail
+// with the errTimedOut. A read in progress is not interrupted.
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if time.Now().After(d.deadline) {
+		return 0, errTimedOut
+	}
+	return d.r.Read(p)
+}
+
+// errWrite is the error of the search failed writing the output.
+var errWrite = errors.New("write error")
+
+// ring keeps up to its capacity of the most recently pushed lines.
+type ring struct {
+	lines []inputLine
+	start int
+}
+
+func newRing(size int) *ring {
+	return &ring{lines: make([]inputLine, 0, size)}
+}
+
+// push adds the line, dropping the oldest one if the ring is full.
+func (r *ring) push(line inputLine) {
+	switch {
+	case cap(r.lines) == 0:
+	case len(r.lines) < cap(r.lines):
+		r.lines = append(r.lines, line)
+	default:
+		r.lines[r.start] = line
+		r.start = (r.start + 1) % len(r.lines)
+	}
+}
+
+// get returns the i-th oldest line.
+func (r *ring) get(i int) inputLine {
+	return r.lines[(r.start+i)%len(r.lines)]
+}
+
+func (r *ring) len() int {
+	return len(r.lines)
+}
 
-	return count > 0
+func (r *ring) reset() {
+	r.lines = r.lines[:0]
+	r.start = 0
 }
@@ -3,11 +3,24 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 var testdata = []struct {
@@ -30,6 +43,96 @@ var testdata = []struct {
 		"./testdata/hello stdin",
 		"./testdata/hello stdin.in",
 	},
+	{
+		"-H",
+		"hello",
+		"",
+
+		true,
+		"",
+		"./testdata/H hello stdin",
+		"./testdata/hello stdin.in",
+	},
+	{
+		"-H -n --label=piped",
+		"hello",
+		"",
+
+		true,
+		"",
+		"./testdata/Hn label hello stdin",
+		"./testdata/hello stdin.in",
+	},
+	{
+		"-n --encoding=utf-16",
+		"é|😀",
+		"./testdata/utf16le",
+
+		true,
+		"",
+		"./testdata/n encoding-utf16 e,smiley utf16le",
+		"",
+	},
+	{
+		"-n --encoding=UTF-16BE",
+		"é|😀",
+		"./testdata/utf16be",
+
+		true,
+		"",
+		"./testdata/n encoding-utf16 e,smiley utf16le",
+		"",
+	},
+	{
+		"-n --encoding=auto",
+		"é|😀",
+		"./testdata/utf8bom",
+
+		true,
+		"",
+		"./testdata/n encoding-utf16 e,smiley utf16le",
+		"",
+	},
+	{
+		"-n --encoding=auto",
+		"é|😀",
+		"./testdata/utf16le",
+
+		true,
+		"",
+		"./testdata/n encoding-utf16 e,smiley utf16le",
+		"",
+	},
+	{
+		"-n --encoding=auto",
+		"é|😀",
+		"./testdata/utf32be",
+
+		true,
+		"",
+		"./testdata/n encoding-utf16 e,smiley utf16le",
+		"",
+	},
+	{
+		"-o --encoding=latin1",
+		"caf.|ï",
+		"./testdata/latin1",
+
+		true,
+		"",
+		"./testdata/o encoding-latin1 cafe,i latin1",
+		"",
+	},
+	{
+		"--label=piped",
+		"hello|and",
+		"./testdata/golang -",
+
+		true,
+		"",
+		"./testdata/label helloand golang,stdin",
+		"./testdata/hello stdin.in",
+	},
 	{
 		"",
 		"and|open",
@@ -50,6 +153,36 @@ var testdata = []struct {
 		"./testdata/andopen golang,grep",
 		"",
 	},
+	{
+		"",
+		"hello|and",
+		"./testdata/golang - ./testdata/words",
+
+		true,
+		"",
+		"./testdata/helloand golang,stdin,words",
+		"./testdata/hello stdin.in",
+	},
+	{
+		"--files-from=./testdata/files",
+		"and|open",
+		"",
+
+		true,
+		"",
+		"./testdata/andopen golang,grep",
+		"",
+	},
+	{
+		"--files-from=-",
+		"and|open",
+		"",
+
+		true,
+		"",
+		"./testdata/andopen golang,grep",
+		"./testdata/files",
+	},
 	{
 		"-c",
 		"and|open",
@@ -70,6 +203,76 @@ var testdata = []struct {
 		"./testdata/c andopen golang,grep",
 		"",
 	},
+	{
+		"-c --include-zero",
+		"Go",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/c include-zero Go golang,grep",
+		"",
+	},
+	{
+		"-l -c",
+		"and|open",
+		"./testdata/golang ./testdata/crlf ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/lc andopen golang,crlf,grep",
+		"",
+	},
+	{
+		"-l -c --include-zero",
+		"Thompson",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/lc include-zero Thompson golang,grep",
+		"",
+	},
+	{
+		"--count-total",
+		"and|open",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/count-total andopen golang,grep",
+		"",
+	},
+	{
+		"--count-total -m3",
+		"and|open",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/count-total m3 andopen golang,grep",
+		"",
+	},
+	{
+		"--count-matches",
+		"and|the",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/count-matches andthe golang,grep",
+		"",
+	},
+	{
+		"--count-matches -m5",
+		"and|the",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/count-matches m5 andthe golang,grep",
+		"",
+	},
 	{
 		"-c -v",
 		"and|open",
@@ -171,139 +374,3993 @@ var testdata = []struct {
 		"",
 	},
 	{
-		"-c -q",
-		"and|open",
+		"-n -A1",
+		"and",
+		"./testdata/grep",
+
+		true,
+		"",
+		"./testdata/nA1 and grep",
+		"",
+	},
+	{
+		"-A2",
+		"and",
 		"./testdata/golang ./testdata/grep",
 
 		true,
 		"",
+		"./testdata/A2 and golang,grep",
+		"",
+	},
+	{
+		"-A2 --group-separator=~~",
+		"and",
+		"./testdata/golang ./testdata/grep",
+
+		true,
 		"",
+		"./testdata/A2 group-separator and golang,grep",
 		"",
 	},
-}
+	{
+		"-A2 --no-group-separator",
+		"and",
+		"./testdata/golang ./testdata/grep",
 
-func TestGrep(t *testing.T) {
+		true,
+		"",
+		"./testdata/A2 no-group-separator and golang,grep",
+		"",
+	},
+	{
+		"-n -B2",
+		"and",
+		"./testdata/grep",
 
-	// This test is brutal no doubt. Let say next time it will be better.
+		true,
+		"",
+		"./testdata/nB2 and grep",
+		"",
+	},
+	{
+		"-A1 -B3",
+		"that",
+		"./testdata/golang ./testdata/grep",
 
-	for _, test := range testdata {
-		Flags.CountOnly = false
-		Flags.FilesWithMatch = false
-		Flags.FilesWithoutMatch = false
-		Flags.Invert = false
-		Flags.LineNumbers = false
-		Flags.NoErrorMessages = false
-		Flags.NoFilename = false
-		Flags.Quiet = false
+		true,
+		"",
+		"./testdata/A1B3 that golang,grep",
+		"",
+	},
+	{
+		"--after-context=1 --before-context=3",
+		"that",
+		"./testdata/golang ./testdata/grep",
 
-		for _, f := range strings.Split(test.flags, " ") {
-			switch f {
-			case "-c":
-				Flags.CountOnly = true
-			case "-l":
-				Flags.FilesWithMatch = true
-			case "-L":
-				Flags.FilesWithoutMatch = true
-			case "-v":
-				Flags.Invert = true
-			case "-n":
-				Flags.LineNumbers = true
-			case "-s":
-				Flags.NoErrorMessages = true
-			case "-h":
-				Flags.NoFilename = true
-			case "-q":
-				Flags.Quiet = true
-			}
-		}
+		true,
+		"",
+		"./testdata/A1B3 that golang,grep",
+		"",
+	},
+	{
+		"-n -C2",
+		"and",
+		"./testdata/golang ./testdata/grep",
 
-		buferr := &bytes.Buffer{}
-		bufout := &bytes.Buffer{}
+		true,
+		"",
+		"./testdata/nC2 and golang,grep",
+		"",
+	},
+	{
+		"-A3 -C1",
+		"that",
+		"./testdata/grep",
 
-		stderr = buferr
-		stdout = bufout
+		true,
+		"",
+		"./testdata/A3C1 that grep",
+		"",
+	},
+	{
+		"--after-context=3 --context=1",
+		"that",
+		"./testdata/grep",
 
-		if test.pathStdin != "" {
-			f, err := os.Open(test.pathStdin)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				return
-			}
-			defer f.Close()
-			b, err := ioutil.ReadAll(f)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				return
-			}
-			stdin = strings.NewReader(string(b))
-		}
+		true,
+		"",
+		"./testdata/A3C1 that grep",
+		"",
+	},
+	{
+		"-i",
+		"Hello",
+		"",
 
-		var paths []string
-		if test.paths != "" {
-			paths = strings.Split(test.paths, " ")
-		}
+		true,
+		"",
+		"./testdata/i hello case",
+		"./testdata/hello case.in",
+	},
+	{
+		"-i",
+		"(",
+		"./testdata/golang",
 
-		match := Grep(test.pattern, paths)
-		if match != test.match {
-			t.Fatalf("context %q expected %v got %v", test.pathStdout, test.match, match)
-		}
+		false,
+		"fake/whatever",
+		"",
+		"",
+	},
+	{
+		"-F",
+		"a.c",
+		"./testdata/fixed",
 
-		switch test.pathStderr {
-		case "":
-			if buferr.String() != "" {
-				t.Fatalf("expected stderr \"\" got %q", buferr.String())
-			}
-		case "fake/whatever":
+		true,
+		"",
+		"./testdata/F a.c fixed",
+		"",
+	},
+	{
+		"-F -i",
+		"a.c",
+		"./testdata/fixed",
+
+		true,
+		"",
+		"./testdata/Fi a.c fixed",
+		"",
+	},
+	{
+		"-F",
+		"func()",
+		"./testdata/fixed",
+
+		true,
+		"",
+		"./testdata/F func() fixed",
+		"",
+	},
+	{
+		"--gzip -n",
+		"error",
+		"./testdata/log.gz ./testdata/gzipped",
+
+		true,
+		"",
+		"./testdata/gzip n error log.gz,gzipped",
+		"",
+	},
+	{
+		"",
+		"foo",
+		"./testdata/binary",
+
+		true,
+		"",
+		"./testdata/foo binary",
+		"",
+	},
+	{
+		"-c",
+		"foo",
+		"./testdata/binary",
+
+		true,
+		"",
+		"./testdata/c foo binary",
+		"",
+	},
+	{
+		"-I",
+		"foo",
+		"./testdata/binary",
+
+		false,
+		"",
+		"",
+		"",
+	},
+	{
+		"-a -n",
+		"foo",
+		"./testdata/binary",
+
+		true,
+		"",
+		"./testdata/an foo binary",
+		"",
+	},
+	{
+		"-a -I",
+		"foo",
+		"./testdata/binary",
+
+		false,
+		"",
+		"",
+		"",
+	},
+	{
+		"-I -a",
+		"foo",
+		"./testdata/binary",
+
+		true,
+		"",
+		"./testdata/a foo binary",
+		"",
+	},
+	{
+		"-w",
+		"cat",
+		"./testdata/words",
+
+		true,
+		"",
+		"./testdata/w cat words",
+		"",
+	},
+	{
+		"-w -i",
+		"cat",
+		"./testdata/words",
+
+		true,
+		"",
+		"./testdata/wi cat words",
+		"",
+	},
+	{
+		"-w -v",
+		"cat",
+		"./testdata/words",
+
+		true,
+		"",
+		"./testdata/wv cat words",
+		"",
+	},
+	{
+		"-w",
+		"cat|dog",
+		"./testdata/words",
+
+		true,
+		"",
+		"./testdata/w catdog words",
+		"",
+	},
+	{
+		"-x",
+		"apple",
+		"./testdata/exact",
+
+		true,
+		"",
+		"./testdata/x apple exact",
+		"",
+	},
+	{
+		"-x -v",
+		"apple",
+		"./testdata/exact",
+
+		true,
+		"",
+		"./testdata/xv apple exact",
+		"",
+	},
+	{
+		"-x -F",
+		"a.c",
+		"./testdata/fixed",
+
+		true,
+		"",
+		"./testdata/xF a.c fixed",
+		"",
+	},
+	{
+		"-x -i",
+		"apple|pineapple",
+		"./testdata/exact",
+
+		true,
+		"",
+		"./testdata/xi applepineapple exact",
+		"",
+	},
+	{
+		"-r",
+		"that",
+		"./testdata/input",
+
+		true,
+		"",
+		"./testdata/that input,all",
+		"",
+	},
+	{
+		"-r -n",
+		"Thompson",
+		"./testdata/input",
+
+		true,
+		"",
+		"./testdata/rn Thompson input",
+		"",
+	},
+	{
+		"",
+		"that",
+		"./testdata/input",
+
+		false,
+		"fake/whatever",
+		"",
+		"",
+	},
+	{
+		"-R",
+		"Thompson",
+		"./testdata/deref",
+
+		true,
+		"fake/whatever",
+		"./testdata/R Thompson deref",
+		"",
+	},
+	{
+		"-r",
+		"Thompson",
+		"./testdata/deref",
+
+		false,
+		"",
+		"",
+		"",
+	},
+	{
+		"-r",
+		"foo",
+		"./testdata/depth ./testdata/depth/a/",
+
+		true,
+		"",
+		"./testdata/r foo depth,depth-a",
+		"",
+	},
+	{
+		"-r",
+		"foo",
+		"./testdata/hidden",
+
+		true,
+		"",
+		"./testdata/r foo hidden",
+		"",
+	},
+	{
+		"-r --hidden",
+		"foo",
+		"./testdata/hidden",
+
+		true,
+		"",
+		"./testdata/r hidden foo hidden",
+		"",
+	},
+	{
+		"-r",
+		"foo",
+		"./testdata/mixed",
+
+		true,
+		"",
+		"./testdata/r foo mixed",
+		"",
+	},
+	{
+		"-r --text-only",
+		"foo",
+		"./testdata/mixed",
+
+		true,
+		"",
+		"./testdata/r text-only foo mixed",
+		"",
+	},
+	{
+		"--text-only",
+		"foo",
+		"./testdata/mixed/logo.png",
+
+		true,
+		"",
+		"./testdata/text-only foo logo.png",
+		"",
+	},
+	{
+		"-r --basename",
+		"foo",
+		"./testdata/depth",
+
+		true,
+		"",
+		"./testdata/r basename foo depth",
+		"",
+	},
+	{
+		"-r -l --full-path --basename",
+		"foo",
+		"./testdata/depth",
+
+		true,
+		"",
+		"./testdata/rl basename foo depth",
+		"",
+	},
+	{
+		"-r --max-depth=1",
+		"foo",
+		"./testdata/depth",
+
+		true,
+		"",
+		"./testdata/r max-depth1 foo depth",
+		"",
+	},
+	{
+		"-R --max-depth=0",
+		"Thompson",
+		"./testdata/deref",
+
+		false,
+		"",
+		"",
+		"",
+	},
+	{
+		"-r --include=*.c",
+		"foo",
+		"./testdata/filter",
+
+		true,
+		"",
+		"./testdata/r include c filter",
+		"",
+	},
+	{
+		"-r --include=*.c --exclude=*_test.c",
+		"foo",
+		"./testdata/filter",
+
+		true,
+		"",
+		"./testdata/r include c exclude test filter",
+		"",
+	},
+	{
+		"-r --exclude=*_test.c --include=*.c --include=*.txt",
+		"foo",
+		"./testdata/filter",
+
+		true,
+		"",
+		"./testdata/r include c,txt exclude test filter",
+		"",
+	},
+	{
+		"-r --exclude=*.c",
+		"foo",
+		"./testdata/filter",
+
+		true,
+		"",
+		"./testdata/r exclude c filter",
+		"",
+	},
+	{
+		"-o -n",
+		"pro[a-z]*",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/on pro golang",
+		"",
+	},
+	{
+		"-o",
+		"and|open",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/o andopen golang,grep",
+		"",
+	},
+	{
+		"-o",
+		"pro|programm",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/o proprogramm golang",
+		"",
+	},
+	{
+		"-o --posix",
+		"pro|programm",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/o posix proprogramm golang",
+		"",
+	},
+	{
+		"-o --only=1 -n",
+		"id=([0-9]+)",
+		"./testdata/requests",
+
+		true,
+		"",
+		"./testdata/o only1 n id requests",
+		"",
+	},
+	{
+		"-o --only=2 -b",
+		"(GET|POST) /[a-z]( id=([0-9]+))?",
+		"./testdata/requests",
+
+		true,
+		"",
+		"./testdata/o only2 b getpost requests",
+		"",
+	},
+	{
+		"-o --only=2",
+		"id=([0-9]+)",
+		"./testdata/requests",
+
+		false,
+		"fake/whatever",
+		"",
+		"",
+	},
+	{
+		"-o -v",
+		"and|open",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/ov andopen golang",
+		"",
+	},
+	{
+		"-o -v -n -b",
+		" |,",
+		"./testdata/grep",
+
+		true,
+		"",
+		"./testdata/ovnb space,comma grep",
+		"",
+	},
+	{
+		"-m2",
+		"and",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/m2 and golang,grep",
+		"",
+	},
+	{
+		"-c -m3",
+		"and|open",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/cm3 andopen golang,grep",
+		"",
+	},
+	{
+		"-c -v -m7",
+		"and|open",
+		"./testdata/grep",
+
+		true,
+		"",
+		"./testdata/cvm7 andopen grep",
+		"",
+	},
+	{
+		"-c -v",
+		"an",
+		"./testdata/nonl",
+
+		true,
+		"",
+		"./testdata/cv an nonl",
+		"",
+	},
+	{
+		"-c -v -m2",
+		"an",
+		"./testdata/nonl",
+
+		true,
+		"",
+		"./testdata/cvm2 an nonl",
+		"",
+	},
+	{
+		"-v -n",
+		"an",
+		"./testdata/nonl",
+
+		true,
+		"",
+		"./testdata/vn an nonl",
+		"",
+	},
+	{
+		"-c -v --include-zero",
+		".",
+		"./testdata/nonl ./testdata/golang",
+
+		true,
+		"",
+		"./testdata/cv include-zero dot nonl,golang",
+		"",
+	},
+	{
+		"-c -v",
+		"an",
+		"",
+
+		true,
+		"",
+		"./testdata/cv an nonl",
+		"./testdata/nonl",
+	},
+	{
+		"-n -m2 -A2",
+		"and",
+		"./testdata/grep",
+
+		true,
+		"",
+		"./testdata/nm2A2 and grep",
+		"",
+	},
+	{
+		"-b",
+		"and",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/b and golang",
+		"",
+	},
+	{
+		"-n --column",
+		"and|open",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/n column andopen golang",
+		"",
+	},
+	{
+		"-o -b --column",
+		"and|open",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/ob column andopen golang",
+		"",
+	},
+	{
+		"-o --unique",
+		"and|the|[Gg]rep",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/o unique andthegrep golang,grep",
+		"",
+	},
+	{
+		"-o --unique-global",
+		"and|the|[Gg]rep",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/o unique-global andthegrep golang,grep",
+		"",
+	},
+	{
+		"-n --total-max=5",
+		"and",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/n total-max and golang,grep",
+		"",
+	},
+	{
+		"-n --heading",
+		"and|open",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/n heading andopen golang,grep",
+		"",
+	},
+	{
+		"-A1 --heading",
+		"and|open",
+		"./testdata/golang ./testdata/crlf ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/A1 heading andopen golang,crlf,grep",
+		"",
+	},
+	{
+		"-l",
+		"foo|qux|cat",
+		"./testdata/crlf ./testdata/nonl ./testdata/words",
+
+		true,
+		"",
+		"./testdata/l fooquxcat crlf,nonl,words",
+		"",
+	},
+	{
+		"-L",
+		"foo|qux|cat",
+		"./testdata/crlf ./testdata/nonl ./testdata/words",
+
+		false,
+		"",
+		"./testdata/L fooquxcat crlf,nonl,words",
+		"",
+	},
+	{
+		"-v -l",
+		"foo|qux|cat",
+		"./testdata/crlf ./testdata/nonl ./testdata/words",
+
+		true,
+		"",
+		"./testdata/vl fooquxcat crlf,nonl,words",
+		"",
+	},
+	{
+		"-v -L",
+		"foo|qux|cat",
+		"./testdata/crlf ./testdata/nonl ./testdata/words",
+
+		false,
+		"",
+		"./testdata/vL fooquxcat crlf,nonl,words",
+		"",
+	},
+	{
+		"-n --multiline",
+		`"name".*?"lang"`,
+		"./testdata/multiline",
+
+		true,
+		"",
+		"./testdata/n multiline namelang multiline",
+		"",
+	},
+	{
+		"-n -o --multiline",
+		`bar\nbaz|foo`,
+		"./testdata/multiline",
+
+		true,
+		"",
+		"./testdata/no multiline barbazfoo multiline",
+		"",
+	},
+	{
+		"-o -Z --multiline",
+		`bar\nbaz|foo`,
+		"./testdata/multiline",
+
+		true,
+		"",
+		"./testdata/oZ multiline barbazfoo multiline",
+		"",
+	},
+	{
+		"-c --multiline",
+		`bar$\n^ba`,
+		"./testdata/multiline",
+
+		true,
+		"",
+		"./testdata/c multiline barba multiline",
+		"",
+	},
+	{
+		"-A1 -n --field-separator=|",
+		"and",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/A1n field-separator and golang,grep",
+		"",
+	},
+	{
+		"-c --field-separator=|",
+		"and",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/c field-separator and golang,grep",
+		"",
+	},
+	{
+		"-A1 -n",
+		"and",
+		"./testdata/grep ./testdata/golang",
+
+		true,
+		"",
+		"./testdata/A1n and grep,golang",
+		"",
+	},
+	{
+		"-A1 -n --context-around-file-boundaries",
+		"and",
+		"./testdata/grep ./testdata/golang",
+
+		true,
+		"",
+		"./testdata/A1n context-around-file-boundaries and grep,golang",
+		"",
+	},
+	{
+		"-b -n -o",
+		"pro[a-z]*",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/bno pro golang",
+		"",
+	},
+	{
+		"-b",
+		"foo",
+		"./testdata/crlf",
+
+		true,
+		"",
+		"./testdata/b foo crlf",
+		"",
+	},
+	{
+		"",
+		"foo$",
+		"./testdata/crlf",
+
+		true,
+		"",
+		"./testdata/fooeol crlf",
+		"",
+	},
+	{
+		"-U",
+		"foo$",
+		"./testdata/crlf",
+
+		false,
+		"",
+		"",
+		"",
+	},
+	{
+		"-U",
+		"foo",
+		"./testdata/crlf",
+
+		true,
+		"",
+		"./testdata/U foo crlf",
+		"",
+	},
+	{
+		"-b -o",
+		"foo",
+		"./testdata/crlf",
+
+		true,
+		"",
+		"./testdata/bo foo crlf",
+		"",
+	},
+	{
+		"-b -B1",
+		"foo",
+		"./testdata/crlf",
+
+		true,
+		"",
+		"./testdata/bB1 foo crlf",
+		"",
+	},
+	{
+		"-H",
+		"and",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/H and golang",
+		"",
+	},
+	{
+		"-T -n",
+		"and",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/Tn and golang,grep",
+		"",
+	},
+	{
+		"-A1 -T -b",
+		"and",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/A1Tb and golang",
+		"",
+	},
+	{
+		"-T",
+		"and",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/T and golang",
+		"",
+	},
+	{
+		"-H",
+		"and",
+		"./testdata/golang ./testdata/gol*ng ./testdata//golang",
+
+		true,
+		"",
+		"./testdata/H and golang",
+		"",
+	},
+	{
+		"-h -H",
+		"and",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/H and golang",
+		"",
+	},
+	{
+		"-H -h",
+		"and",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/h and golang,grep",
+		"",
+	},
+	{
+		"-F",
+		"a.c\nfunc()",
+		"./testdata/fixed",
+
+		true,
+		"",
+		"./testdata/F a.c,func() fixed",
+		"",
+	},
+	{
+		"-w",
+		"cat\ndog",
+		"./testdata/words",
+
+		true,
+		"",
+		"./testdata/w cat,dog words",
+		"",
+	},
+	{
+		"-n -w",
+		"^cat",
+		"./testdata/words",
+
+		true,
+		"",
+		"./testdata/nw ^cat words",
+		"",
+	},
+	{
+		"-n -w",
+		"^bird-",
+		"./testdata/words",
+
+		true,
+		"",
+		"./testdata/nw ^bird- words",
+		"",
+	},
+	{
+		"-n -w",
+		"dog\\?$",
+		"./testdata/words",
+
+		true,
+		"",
+		"./testdata/nw dog?$ words",
+		"",
+	},
+	{
+		"-n -w",
+		"^bird-\ncat$",
+		"./testdata/words",
+
+		true,
+		"",
+		"./testdata/nw ^bird-,cat$ words",
+		"",
+	},
+	{
+		"-x",
+		"apple\nApple",
+		"./testdata/exact",
+
+		true,
+		"",
+		"./testdata/x apple,Apple exact",
+		"",
+	},
+	{
+		"",
+		"and\nopen",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/andopen golang,grep",
+		"",
+	},
+	{
+		"",
+		"and\n(",
+		"./testdata/golang",
+
+		false,
+		"fake/whatever",
+		"",
+		"",
+	},
+	{
+		"--color=always -n",
+		"pro[a-z]*",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/color n pro golang",
+		"",
+	},
+	{
+		"--color=always --passthru",
+		"pro[a-z]*",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/color passthru pro golang",
+		"",
+	},
+	{
+		"--color=always --passthru -v",
+		"and",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/color passthru v and golang",
+		"",
+	},
+	{
+		"-n --passthru",
+		"and",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/n passthru and golang,grep",
+		"",
+	},
+	{
+		"-c --passthru",
+		"and|open",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"./testdata/c andopen golang,grep",
+		"",
+	},
+	{
+		"--color=always -o",
+		"and|open",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/color o andopen golang",
+		"",
+	},
+	{
+		"--color=always -m1 -A3 -n",
+		`Go`,
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/color A3m1n Go golang",
+		"",
+	},
+	{
+		"--color=always -n --multiline",
+		`bar\nbaz`,
+		"./testdata/multiline",
+
+		true,
+		"",
+		"./testdata/color n multiline barbaz multiline",
+		"",
+	},
+	{
+		"--color=always -n -o --multiline",
+		`bar\nbaz`,
+		"./testdata/multiline",
+
+		true,
+		"",
+		"./testdata/color no multiline barbaz multiline",
+		"",
+	},
+	{
+		"--color=never",
+		"and|open",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/andopen golang",
+		"",
+	},
+	{
+		"--color=auto",
+		"and|open",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/andopen golang",
+		"",
+	},
+	{
+		"--color=always -v",
+		"and|open",
+		"./testdata/golang",
+
+		true,
+		"",
+		"./testdata/v andopen golang",
+		"",
+	},
+	{
+		"-G",
+		"c\\(at\\)\\{1\\}",
+		"./testdata/words",
+
+		true,
+		"",
+		"./testdata/G catgroup words",
+		"",
+	},
+	{
+		"-G",
+		"cat\\|dog",
+		"./testdata/words",
+
+		true,
+		"",
+		"./testdata/G cat,dog words",
+		"",
+	},
+	{
+		"-G",
+		"cat|dog",
+		"./testdata/words",
+
+		false,
+		"",
+		"",
+		"",
+	},
+	{
+		"-G -E",
+		"cat|dog",
+		"./testdata/words",
+
+		true,
+		"",
+		"./testdata/G cat,dog words",
+		"",
+	},
+	{
+		"-E -G",
+		"cat|dog",
+		"./testdata/words",
+
+		false,
+		"",
+		"",
+		"",
+	},
+	{
+		"-c -q",
+		"and|open",
+		"./testdata/golang ./testdata/grep",
+
+		true,
+		"",
+		"",
+		"",
+	},
+}
+
+func TestGrep(t *testing.T) {
+
+	// This test is brutal no doubt. Let say next time it will be better.
+
+	defaults := Flags
+	defer func() { Flags = defaults }()
+
+	for _, test := range testdata {
+		Flags = Options{}
+
+		for _, f := range strings.Split(test.flags, " ") {
+			switch f {
+			case "-U":
+				Flags.Binary = true
+			case "-a":
+				flag.Set("a", "true")
+			case "-b":
+				Flags.ByteOffset = true
+			case "-c":
+				Flags.CountOnly = true
+			case "--count-matches":
+				Flags.CountMatches = true
+			case "--count-total":
+				Flags.CountTotal = true
+			case "--column":
+				Flags.Column.Set("true")
+			case "-R":
+				Flags.Dereference = true
+			case "-l":
+				Flags.FilesWithMatch = true
+			case "-L":
+				Flags.FilesWithoutMatch = true
+			case "-E":
+				flag.Set("E", "true")
+			case "-G":
+				flag.Set("G", "true")
+			case "-F":
+				Flags.FixedStrings = true
+			case "--gzip":
+				Flags.Gzip = true
+			case "-i":
+				Flags.IgnoreCase = true
+			case "--include-zero":
+				Flags.IncludeZero = true
+			case "-I":
+				flag.Set("I", "true")
+			case "-v":
+				Flags.Invert = true
+			case "-x":
+				Flags.LineMatch = true
+			case "-n":
+				Flags.LineNumbers = true
+			case "-s":
+				Flags.NoErrorMessages = true
+			case "--no-group-separator":
+				Flags.NoGroupSeparator = true
+			case "-h":
+				flag.Set("h", "true")
+			case "--context-around-file-boundaries":
+				Flags.FileBoundaries = true
+			case "--multiline":
+				Flags.Multiline = true
+			case "--posix":
+				Flags.Posix = true
+			case "--heading":
+				Flags.Heading = true
+			case "--hidden":
+				Flags.Hidden = true
+			case "--basename":
+				flag.Set("basename", "true")
+			case "--full-path":
+				flag.Set("full-path", "true")
+			case "-H":
+				flag.Set("H", "true")
+			case "-o":
+				Flags.OnlyMatching = true
+			case "--passthru":
+				Flags.Passthru = true
+			case "-q":
+				Flags.Quiet = true
+			case "-r":
+				Flags.Recursive = true
+			case "--text-only":
+				Flags.TextOnly = true
+			case "--unique":
+				Flags.Unique = true
+			case "--unique-global":
+				Flags.UniqueGlobal = true
+			case "-w":
+				Flags.WordMatch = true
+			case "-T":
+				Flags.InitialTab = true
+			case "-Z":
+				Flags.NullName = true
+			default:
+				switch {
+				case strings.HasPrefix(f, "-A"):
+					Flags.AfterContext, _ = strconv.Atoi(f[2:])
+				case strings.HasPrefix(f, "-B"):
+					Flags.BeforeContext, _ = strconv.Atoi(f[2:])
+				case strings.HasPrefix(f, "-C"):
+					Flags.Context, _ = strconv.Atoi(f[2:])
+				case strings.HasPrefix(f, "--after-context="):
+					flag.Set("after-context", strings.TrimPrefix(f, "--after-context="))
+				case strings.HasPrefix(f, "--before-context="):
+					flag.Set("before-context", strings.TrimPrefix(f, "--before-context="))
+				case strings.HasPrefix(f, "--context="):
+					flag.Set("context", strings.TrimPrefix(f, "--context="))
+				case strings.HasPrefix(f, "-m"):
+					Flags.MaxCount, _ = strconv.Atoi(f[2:])
+				case strings.HasPrefix(f, "--color="):
+					Flags.Color.Set(strings.TrimPrefix(f, "--color="))
+				case strings.HasPrefix(f, "--encoding="):
+					Flags.Encoding.Set(strings.TrimPrefix(f, "--encoding="))
+				case strings.HasPrefix(f, "--exclude="):
+					Flags.Exclude.Set(strings.TrimPrefix(f, "--exclude="))
+				case strings.HasPrefix(f, "--files-from="):
+					Flags.FilesFrom = strings.TrimPrefix(f, "--files-from=")
+				case strings.HasPrefix(f, "--group-separator="):
+					Flags.GroupSeparator = strings.TrimPrefix(f, "--group-separator=")
+				case strings.HasPrefix(f, "--label="):
+					Flags.Label = strings.TrimPrefix(f, "--label=")
+				case strings.HasPrefix(f, "--max-depth="):
+					Flags.MaxDepth.Set(strings.TrimPrefix(f, "--max-depth="))
+				case strings.HasPrefix(f, "--only="):
+					Flags.OnlyGroup, _ = strconv.Atoi(strings.TrimPrefix(f, "--only="))
+				case strings.HasPrefix(f, "--field-separator="):
+					Flags.FieldSeparator = strings.TrimPrefix(f, "--field-separator=")
+				case strings.HasPrefix(f, "--total-max="):
+					Flags.TotalMax, _ = strconv.Atoi(strings.TrimPrefix(f, "--total-max="))
+				case strings.HasPrefix(f, "--include="):
+					Flags.Include.Set(strings.TrimPrefix(f, "--include="))
+				}
+			}
+		}
+
+		buferr := &bytes.Buffer{}
+		bufout := &bytes.Buffer{}
+
+		g := NewGrepper(Flags)
+		g.Stderr = buferr
+		g.Stdout = bufout
+
+		var stdin []byte
+		if test.pathStdin != "" {
+			f, err := os.Open(test.pathStdin)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			defer f.Close()
+			stdin, err = ioutil.ReadAll(f)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			g.Stdin = bytes.NewReader(stdin)
+		}
+
+		var paths []string
+		if test.paths != "" {
+			paths = strings.Split(test.paths, " ")
+		}
+
+		match, err := g.Search(test.pattern, paths)
+		if err != nil {
+			// Printed by the command as well.
+			fmt.Fprintln(buferr, err)
+		}
+		if match != test.match {
+			t.Fatalf("context %q expected %v got %v", test.pathStdout, test.match, match)
+		}
+
+		if paths != nil {
+			// Searching the files by several jobs, or mapped into the
+			// memory, writes the same.
+			for flag, set := range map[string]func(*Grepper){
+				"-j4":    func(j *Grepper) { j.Jobs = 4 },
+				"--mmap": func(j *Grepper) { j.Mmap = true },
+			} {
+				jobout := &bytes.Buffer{}
+				joberr := &bytes.Buffer{}
+
+				j := NewGrepper(Flags)
+				set(j)
+				j.Stderr = joberr
+				j.Stdout = jobout
+				j.Stdin = bytes.NewReader(stdin)
+
+				jobMatch, err := j.Search(test.pattern, paths)
+				if err != nil {
+					fmt.Fprintln(joberr, err)
+				}
+				if jobMatch != match {
+					t.Fatalf("context %q %s expected %v got %v", test.pathStdout, flag, match, jobMatch)
+				}
+				if jobout.String() != bufout.String() {
+					t.Fatalf("context %q %s expected stdout %q got %q", test.pathStdout, flag, bufout.String(), jobout.String())
+				}
+				if joberr.String() != buferr.String() {
+					t.Fatalf("context %q %s expected stderr %q got %q", test.pathStdout, flag, buferr.String(), joberr.String())
+				}
+			}
+		}
+
+		switch test.pathStderr {
+		case "":
+			if buferr.String() != "" {
+				t.Fatalf("expected stderr \"\" got %q", buferr.String())
+			}
+		case "fake/whatever":
 			if buferr.String() == "" {
 				t.Fatal("expected some stderr, got none")
 			}
 		}
 
-		if test.pathStdout == "" {
-			if bufout.String() != "" {
-				t.Fatalf("expected stdout \"\" got %q", bufout.String())
+		if test.pathStdout == "" {
+			if bufout.String() != "" {
+				t.Fatalf("expected stdout \"\" got %q", bufout.String())
+			}
+		} else {
+			goldenFile, err := os.Open(test.pathStdout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer goldenFile.Close()
+			goldenScan := bufio.NewScanner(goldenFile)
+			actualScan := bufio.NewScanner(bufout)
+
+			for goldenScan.Scan() {
+				if !actualScan.Scan() {
+					t.Fatal("context", test.pathStdout, "unexpected eof")
+				}
+
+				if goldenScan.Text() != actualScan.Text() {
+					t.Fatalf("context %q expected %q got %q", test.pathStdout, goldenScan.Text(), actualScan.Text())
+				}
+			}
+
+			if actualScan.Scan() {
+				t.Fatalf("context %q unexpected %q", test.pathStdout, actualScan.Text())
+			}
+
+			if err := goldenScan.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := actualScan.Err(); err != nil {
+				t.Fatal("unexpected error", err)
+			}
+		}
+
+		if g.Quiet {
+			if g.stderr != g.Stderr {
+				t.Fatal("expected stderr kept if -q")
+			}
+			if g.stdout != ioutil.Discard {
+				t.Fatal("expected stdout set to ioutil.Discard if -q")
+			}
+		}
+	}
+}
+
+func TestGreppers(t *testing.T) {
+	bufout1 := &bytes.Buffer{}
+	g1 := &Grepper{
+		Options: Options{CountOnly: true},
+		Stdout:  bufout1,
+		Stderr:  &bytes.Buffer{},
+	}
+
+	bufout2 := &bytes.Buffer{}
+	g2 := &Grepper{
+		Options: Options{LineNumbers: true, IgnoreCase: true},
+		Stdout:  bufout2,
+		Stderr:  &bytes.Buffer{},
+	}
+
+	for _, g := range []*Grepper{g1, g2, g1} {
+		if match, err := g.Search("GRAMMING", []string{"./testdata/golang"}); err != nil {
+			t.Fatal(err)
+		} else if match != (g == g2) {
+			t.Fatalf("expected match %v got %v", g == g2, match)
+		}
+	}
+
+	if bufout1.String() != "" {
+		t.Fatalf("expected stdout \"\" got %q", bufout1.String())
+	}
+
+	expected := "1:The Go programming language is an open source project to make programmers more\n"
+	if bufout2.String() != expected {
+		t.Fatalf("expected %q got %q", expected, bufout2.String())
+	}
+}
+
+func TestCompilePatternError(t *testing.T) {
+	g := &Grepper{Options: Options{IgnoreCase: true}}
+
+	_, err := g.compilePattern("(")
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if strings.Contains(err.Error(), "(?i)") {
+		t.Fatalf("expected error for the original pattern, got %q", err)
+	}
+}
+
+func TestCheckPattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		opts     Options
+		code     int
+		expected string
+	}{
+		{"a(b|c)+", Options{}, 0, "OK\n"},
+		{"a(b", Options{}, 2, ""},
+		{"a(b", Options{FixedStrings: true}, 0, "OK\n"},
+		{"a\\(b\\)", Options{BasicRegexp: true, WordMatch: true, IgnoreCase: true}, 0, "OK\n"},
+		{"ok\n[", Options{LineMatch: true}, 2, ""},
+	}
+
+	for _, test := range tests {
+		bufout := &bytes.Buffer{}
+		buferr := &bytes.Buffer{}
+
+		code := checkPattern(strings.Split(test.pattern, "\n"), test.opts, bufout, buferr)
+		if code != test.code {
+			t.Fatalf("%q: expected exit code %d got %d", test.pattern, test.code, code)
+		}
+		if bufout.String() != test.expected {
+			t.Fatalf("%q: expected %q got %q", test.pattern, test.expected, bufout.String())
+		}
+		if (code != 0) != (buferr.String() != "") {
+			t.Fatalf("%q: unexpected stderr %q", test.pattern, buferr.String())
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		pattern string
+		paths   []string
+		opts    Options
+		code    int
+	}{
+		{"and", []string{"./testdata/golang"}, Options{}, 0},
+		{"nomatchforsure", []string{"./testdata/golang"}, Options{}, 1},
+		{"(", []string{"./testdata/golang"}, Options{}, 2},
+		{"and", []string{"./testdata/nonexistent"}, Options{}, 2},
+		{"and", []string{"./testdata/input"}, Options{}, 2},
+		{"and", []string{"./testdata/nonexistent"}, Options{NoErrorMessages: true}, 1},
+		{"and", []string{"./testdata/nonexistent"}, Options{Jobs: 4}, 2},
+		{"and", []string{"./testdata/golang", "./testdata/nonexistent"}, Options{}, 2},
+		{"and", []string{"./testdata/nonexistent", "./testdata/golang"}, Options{Jobs: 4}, 2},
+		{"and", []string{"./testdata/golang", "./testdata/input"}, Options{}, 2},
+		{"and", []string{"./testdata/golang", "./testdata/nonexistent"}, Options{NoErrorMessages: true}, 0},
+		{"and", []string{"./testdata/nonexistent", "./testdata/golang"}, Options{Quiet: true}, 0},
+	}
+
+	for _, test := range tests {
+		g := &Grepper{Options: test.opts, Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+
+		if code := run(context.Background(), g, strings.Split(test.pattern, "\n"), test.paths); code != test.code {
+			t.Fatalf("%q %q: expected exit code %d got %d", test.pattern, test.paths, test.code, code)
+		}
+	}
+}
+
+func TestExcludeDir(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"build/main.o", "src/main.c", "src/vendor/lib.c", "src/build"} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("foo\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bufout := &bytes.Buffer{}
+	g := &Grepper{
+		Options: Options{
+			Recursive:  true,
+			ExcludeDir: globList{"build", "vend*"},
+		},
+		Stdout: bufout,
+		Stderr: &bytes.Buffer{},
+	}
+
+	if match, err := g.Search("foo", []string{root}); err != nil || !match {
+		t.Fatal("expected match")
+	}
+
+	// The files are not excluded by the --exclude-dir, only directories.
+	expected := filepath.Join(root, "src/build") + ":foo\n" + filepath.Join(root, "src/main.c") + ":foo\n"
+	if bufout.String() != expected {
+		t.Fatalf("expected %q got %q", expected, bufout.String())
+	}
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestMaxCountStopsEarly(t *testing.T) {
+	input := strings.Repeat("match\n", 100000)
+	in := &countingReader{r: strings.NewReader(input)}
+
+	bufout := &bytes.Buffer{}
+	g := &Grepper{
+		Options: Options{MaxCount: 1, CountOnly: true},
+		Stdin:   in,
+		Stdout:  bufout,
+		Stderr:  &bytes.Buffer{},
+	}
+
+	if match, err := g.Search("match", nil); err != nil || !match {
+		t.Fatal("expected match")
+	}
+	if bufout.String() != "1\n" {
+		t.Fatalf("expected count capped to 1 got %q", bufout.String())
+	}
+	if in.n >= len(input) {
+		t.Fatalf("expected to stop early, read %d of %d bytes", in.n, len(input))
+	}
+}
+
+func TestTotalMax(t *testing.T) {
+	input := strings.Repeat("match\n", 100000)
+	in := &countingReader{r: strings.NewReader(input)}
+
+	name := filepath.Join(t.TempDir(), "more")
+	if err := os.WriteFile(name, []byte("match\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	bufout := &bytes.Buffer{}
+	g := &Grepper{
+		Options: Options{TotalMax: 3, Jobs: 4},
+		Stdin:   in,
+		Stdout:  bufout,
+		Stderr:  &bytes.Buffer{},
+	}
+
+	if match, err := g.Search("match", []string{"-", name}); err != nil || !match {
+		t.Fatal("expected match")
+	}
+	expected := strings.Repeat("(standard input):match\n", 3)
+	if bufout.String() != expected {
+		t.Fatalf("expected %q got %q", expected, bufout.String())
+	}
+	if in.n >= len(input) {
+		t.Fatalf("expected to stop early, read %d of %d bytes", in.n, len(input))
+	}
+}
+
+// cancelingReader cancels the context on the second read.
+type cancelingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+	read   bool
+}
+
+func (c *cancelingReader) Read(p []byte) (int, error) {
+	if c.read {
+		c.cancel()
+	}
+	c.read = true
+	return c.r.Read(p)
+}
+
+func TestSearchContext(t *testing.T) {
+	input := strings.Repeat("match\n", 100000)
+	in := &countingReader{r: strings.NewReader(input)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bufout := &bytes.Buffer{}
+	g := &Grepper{
+		Stdin:  &cancelingReader{r: in, cancel: cancel},
+		Stdout: bufout,
+		Stderr: &bytes.Buffer{},
+	}
+
+	match, err := g.SearchContext(ctx, "match", nil)
+	if err != context.Canceled {
+		t.Fatal("expected context canceled, got", err)
+	}
+	if !match {
+		t.Fatal("expected match before canceled")
+	}
+	if n := strings.Count(bufout.String(), "\n"); n == 0 || n == 100000 {
+		t.Fatalf("expected the lines before canceled written, got %d", n)
+	}
+	if in.n == len(input) {
+		t.Fatal("expected the search stopped before reading all input")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	g.Stdin = &cancelingReader{r: strings.NewReader(input), cancel: cancel}
+	if code := run(ctx, g, []string{"match"}, nil); code != 130 {
+		t.Fatal("expected exit code 130 if canceled, got", code)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	for jobs, expected := range map[int]int{-1: 1, 0: 1, 1: 1, 4: 4} {
+		g := NewGrepper(Options{Jobs: jobs})
+		if got := g.jobs(); got != expected {
+			t.Errorf("Jobs %d: expected %d jobs got %d", jobs, expected, got)
+		}
+	}
+}
+
+// errNoSpace is the error of the failingWriter.
+var errNoSpace = errors.New("no space left on device")
+
+// failingWriter is a writer failing like a full disk.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: "out", Err: errNoSpace}
+}
+
+func TestWriteError(t *testing.T) {
+	input := strings.Repeat("match\n", 100000)
+	in := &countingReader{r: strings.NewReader(input)}
+	g := &Grepper{
+		Stdin:  in,
+		Stdout: failingWriter{},
+		Stderr: &bytes.Buffer{},
+	}
+
+	_, err := g.Search("match", []string{"-", "./testdata/golang"})
+	if !errors.Is(err, errWrite) || !errors.Is(err, errNoSpace) {
+		t.Fatal("expected write error, got", err)
+	}
+	if in.n == len(input) {
+		t.Fatal("expected the search stopped before reading all input")
+	}
+
+	buferr := &bytes.Buffer{}
+	g.Stdin = strings.NewReader(input)
+	g.Stderr = buferr
+	if code := run(context.Background(), g, []string{"match"}, nil); code != 2 {
+		t.Fatal("expected exit code 2 if failed writing, got", code)
+	}
+	expected := "write error: write out: no space left on device\n"
+	if buferr.String() != expected {
+		t.Fatalf("expected %q got %q", expected, buferr.String())
+	}
+}
+
+// slowReader reads from the underlying reader after a delay.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(p)
+}
+
+func TestTimeout(t *testing.T) {
+	input := strings.Repeat("match\n", 100000)
+
+	for _, quiet := range []bool{false, true} {
+		in := &countingReader{r: strings.NewReader(input)}
+		bufout := &bytes.Buffer{}
+		buferr := &bytes.Buffer{}
+		g := &Grepper{
+			Options: Options{Timeout: time.Millisecond, NoErrorMessages: quiet},
+			Stdin:   &slowReader{r: in, delay: 5 * time.Millisecond},
+			Stdout:  bufout,
+			Stderr:  buferr,
+		}
+
+		if match, err := g.Search("match|programming", []string{"-", "./testdata/golang"}); err != nil || !match {
+			t.Fatal("expected match, got", err)
+		}
+		if in.n == len(input) {
+			t.Fatal("expected the search of the slow file stopped")
+		}
+		if !strings.Contains(bufout.String(), "./testdata/golang:The Go programming language") {
+			t.Fatal("expected the search continued with the next file")
+		}
+
+		expected := "grep: (standard input): timed out after 1ms, the rest is skipped\n"
+		if quiet {
+			expected = ""
+		}
+		if buferr.String() != expected {
+			t.Fatalf("expected %q got %q", expected, buferr.String())
+		}
+	}
+}
+
+func TestTimeoutFewLines(t *testing.T) {
+	// Fewer lines than cancelLines, coming slowly.
+	input := strings.Repeat("match\n", 20)
+	in := &countingReader{r: strings.NewReader(input)}
+	buferr := &bytes.Buffer{}
+	g := &Grepper{
+		Options: Options{Timeout: 50 * time.Millisecond},
+		Stdin:   &slowReader{r: iotest.OneByteReader(in), delay: 5 * time.Millisecond},
+		Stdout:  &bytes.Buffer{},
+		Stderr:  buferr,
+	}
+
+	if match, err := g.Search("match", nil); err != nil || !match {
+		t.Fatal("expected match, got", err)
+	}
+	if in.n == len(input) {
+		t.Fatal("expected the search of the slow input stopped")
+	}
+	expected := "grep: (standard input): timed out after 50ms, the rest is skipped\n"
+	if buferr.String() != expected {
+		t.Fatalf("expected %q got %q", expected, buferr.String())
+	}
+}
+
+func TestQuietStopsEarly(t *testing.T) {
+	for _, opts := range []Options{
+		{Quiet: true},
+		{Quiet: true, CountOnly: true},
+		{Quiet: true, CountMatches: true},
+		{Quiet: true, FilesWithMatch: true},
+	} {
+		input := strings.Repeat("match\n", 100000)
+		in := &countingReader{r: strings.NewReader(input)}
+		bufout := &bytes.Buffer{}
+		g := &Grepper{Options: opts, Stdin: in, Stdout: bufout, Stderr: &bytes.Buffer{}}
+
+		if match, err := g.Search("match", nil); err != nil || !match {
+			t.Fatalf("%+v: expected match", opts)
+		}
+		if bufout.Len() > 0 {
+			t.Fatalf("%+v: unexpected output %q", opts, bufout)
+		}
+		if in.n == len(input) {
+			t.Fatalf("%+v: expected the search stopped before reading all input", opts)
+		}
+	}
+
+	// The files after the first match are not searched.
+	for _, paths := range [][]string{
+		{"./testdata/golang", "./testdata/nonexistent"},
+		{"./testdata/golang", "./testdata/nonexistent*"},
+	} {
+		g := &Grepper{
+			Options: Options{Quiet: true, Jobs: 4},
+			Stdout:  &bytes.Buffer{},
+			Stderr:  &bytes.Buffer{},
+		}
+		if match, err := g.Search("Go", paths); err != nil || !match {
+			t.Fatalf("%v: expected match", paths)
+		}
+		if g.Failed() {
+			t.Fatalf("%v: expected the files after the match not searched", paths)
+		}
+	}
+}
+
+// errReader fails reading after the content of its reader.
+type errReader struct {
+	r io.Reader
+}
+
+func (e errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		err = errors.New("read failed")
+	}
+	return n, err
+}
+
+func TestNoErrorMessages(t *testing.T) {
+	buferr := &bytes.Buffer{}
+	g := &Grepper{
+		Options: Options{NoErrorMessages: true},
+		Stdin:   errReader{strings.NewReader("foo\n")},
+		Stdout:  &bytes.Buffer{},
+		Stderr:  buferr,
+	}
+
+	if match, err := g.Search("foo", []string{"./testdata/nonexistent", "-", "./testdata"}); err != nil || !match {
+		t.Fatal("expected match")
+	}
+
+	expected := "grep: (standard input): read failed\n"
+	if buferr.String() != expected {
+		t.Fatalf("expected stderr %q got %q", expected, buferr.String())
+	}
+	if !g.Failed() {
+		t.Fatal("expected failed by the read error")
+	}
+}
+
+func TestSort(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	for i, f := range []struct {
+		name    string
+		content string
+		age     time.Duration
+	}{
+		{"b", "foo\n", time.Hour},
+		{"c", "foo foo\n", 3 * time.Hour},
+		{"a", "foo foo foo\n", 2 * time.Hour},
+	} {
+		path := filepath.Join(root, f.name)
+		if err := ioutil.WriteFile(path, []byte(f.content), 0644); err != nil {
+			t.Fatal(i, err)
+		}
+		if err := os.Chtimes(path, now, now.Add(-f.age)); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+
+	tests := []struct {
+		sort     sortFlag
+		reverse  bool
+		expected string
+	}{
+		{"name", false, "a,b,c"},
+		{"name", true, "c,b,a"},
+		{"size", false, "b,c,a"},
+		{"size", true, "a,c,b"},
+		{"mtime", false, "c,a,b"},
+		{"mtime", true, "b,a,c"},
+	}
+
+	for _, test := range tests {
+		for _, jobs := range []int{1, 4} {
+			bufout := &bytes.Buffer{}
+			g := &Grepper{
+				Options: Options{Recursive: true, FilesWithMatch: true, Sort: test.sort, SortReverse: test.reverse, Jobs: jobs},
+				Stdout:  bufout,
+				Stderr:  &bytes.Buffer{},
+			}
+
+			if match, err := g.Search("foo", []string{root}); err != nil || !match {
+				t.Fatalf("--sort=%s: expected match", test.sort)
+			}
+
+			var names []string
+			for _, line := range strings.Split(strings.TrimSuffix(bufout.String(), "\n"), "\n") {
+				names = append(names, filepath.Base(line))
+			}
+			if got := strings.Join(names, ","); got != test.expected {
+				t.Fatalf("--sort=%s reverse %v -j%d: expected %s got %s", test.sort, test.reverse, jobs, test.expected, got)
+			}
+		}
+	}
+
+	var s sortFlag
+	if err := s.Set("atime"); err == nil {
+		t.Fatal("expected error for unknown sort key")
+	}
+}
+
+func TestFullPath(t *testing.T) {
+	bufout := &bytes.Buffer{}
+	g := &Grepper{
+		Options: Options{Recursive: true, FilesWithMatch: true, FullPath: true},
+		Stdout:  bufout,
+		Stderr:  &bytes.Buffer{},
+	}
+
+	if match, err := g.Search("foo", []string{"./testdata/depth/a"}); err != nil || !match {
+		t.Fatal("expected match")
+	}
+
+	var expected string
+	for _, name := range []string{"a/b/c/three", "a/b/two", "a/one"} {
+		abs, err := filepath.Abs(filepath.Join("testdata/depth", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected += abs + "\n"
+	}
+	if bufout.String() != expected {
+		t.Fatalf("expected %q got %q", expected, bufout.String())
+	}
+}
+
+func TestCounter(t *testing.T) {
+	tests := []struct {
+		opts     Options
+		expected string
+		counts   Counter
+	}{
+		{Options{CountOnly: true}, "./testdata/golang:4\n./testdata/grep:12\n", Counter{16, 0, 2, 2}},
+		{Options{CountOnly: true, OnlyMatching: true}, "./testdata/golang:4\n./testdata/grep:15\n", Counter{16, 19, 2, 2}},
+		{Options{CountMatches: true}, "./testdata/golang:4\n./testdata/grep:15\n", Counter{16, 19, 2, 2}},
+		{Options{CountTotal: true}, "./testdata/golang:4\n./testdata/grep:12\n(total):16\n", Counter{16, 0, 2, 2}},
+		{Options{CountTotal: true, OnlyMatching: true}, "./testdata/golang:4\n./testdata/grep:15\n(total):19\n", Counter{16, 19, 2, 2}},
+		{Options{CountOnly: true, Invert: true}, "./testdata/golang:6\n./testdata/grep:60\n", Counter{66, 0, 2, 2}},
+		{Options{CountOnly: true, OnlyMatching: true, MaxCount: 3}, "./testdata/golang:3\n./testdata/grep:3\n", Counter{6, 6, 2, 2}},
+		{Options{CountOnly: true, MaxCount: 3}, "./testdata/golang:3\n./testdata/grep:3\n", Counter{6, 0, 2, 2}},
+		{Options{CountOnly: true, Stats: true}, "./testdata/golang:4\n./testdata/grep:12\n", Counter{16, 19, 2, 2}},
+		{Options{FilesWithMatch: true}, "./testdata/golang\n./testdata/grep\n", Counter{2, 0, 2, 2}},
+		{Options{LineMatch: true, CountOnly: true}, "./testdata/golang:0\n./testdata/grep:0\n", Counter{0, 0, 0, 2}},
+	}
+
+	for _, test := range tests {
+		for _, jobs := range []int{1, 4} {
+			bufout := &bytes.Buffer{}
+			g := &Grepper{Options: test.opts, Stdout: bufout, Stderr: &bytes.Buffer{}}
+			g.Jobs = jobs
+			g.IncludeZero = true
+
+			if _, err := g.Search("and", []string{"./testdata/golang", "./testdata/grep"}); err != nil {
+				t.Fatal(err)
+			}
+			if bufout.String() != test.expected {
+				t.Fatalf("%+v: expected %q got %q", test.opts, test.expected, bufout.String())
+			}
+			if g.Counts() != test.counts {
+				t.Fatalf("%+v: expected counts %+v got %+v", test.opts, test.counts, g.Counts())
+			}
+		}
+	}
+}
+
+func TestPatternNull(t *testing.T) {
+	patterns, err := readPatterns("./testdata/nullpatterns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(patterns, []string{"banana\napricot", "cherry"}) {
+		t.Fatalf("expected the patterns separated by the zero bytes, got %q", patterns)
+	}
+
+	bufout := &bytes.Buffer{}
+	g := &Grepper{Options: Options{FixedStrings: true, Multiline: true, LineNumbers: true}, Stdout: bufout, Stderr: &bytes.Buffer{}}
+	if code := run(context.Background(), g, patterns, []string{"./testdata/nonl"}); code != 0 {
+		t.Fatalf("expected exit code 0 got %d", code)
+	}
+
+	expected := "2:banana\napricot\n4:cherry\n"
+	if bufout.String() != expected {
+		t.Fatalf("expected %q got %q", expected, bufout.String())
+	}
+}
+
+func TestStats(t *testing.T) {
+	for _, opts := range []Options{{}, {Jobs: 4}, {Quiet: true}, {Multiline: true}, {Multiline: true, Mmap: true}} {
+		buferr := &bytes.Buffer{}
+		g := &Grepper{Options: opts, Stdout: &bytes.Buffer{}, Stderr: buferr}
+		g.Stats = true
+
+		if _, err := g.Search("and", []string{"./testdata/golang", "./testdata/grep", "./testdata/nonl"}); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "3 files searched\n2 files matched\n16 lines matched\n19 matches\n"
+		if opts.Quiet {
+			expected = "1 files searched\n1 files matched\n1 lines matched\n0 matches\n"
+		}
+		stats := buferr.String()
+		if !strings.HasPrefix(stats, expected) || !strings.HasSuffix(stats, " elapsed\n") {
+			t.Errorf("%+v: expected stats %q and the time elapsed, got %q", opts, expected, stats)
+		}
+	}
+}
+
+func TestCountToStderr(t *testing.T) {
+	tests := []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{Quiet: true}, "16\n"},
+		{Options{Quiet: true, OnlyMatching: true, CountOnly: true}, "19\n"},
+		{Options{Jobs: 4}, "16\n"},
+		{Options{Jobs: 4, NoErrorMessages: true}, "16\n"},
+		{Options{Quiet: true, Invert: true}, "66\n"},
+	}
+
+	for _, test := range tests {
+		bufout := &bytes.Buffer{}
+		buferr := &bytes.Buffer{}
+		g := &Grepper{Options: test.opts, Stdout: bufout, Stderr: buferr}
+		g.CountToStderr = true
+
+		match, err := g.Search("and", []string{"./testdata/golang", "./testdata/missing", "./testdata/grep"})
+		if err != nil || !match {
+			t.Fatalf("%+v: expected match", test.opts)
+		}
+
+		// The error of the missing file is printed before the total,
+		// unless -s.
+		expected := test.expected
+		if !test.opts.NoErrorMessages {
+			expected = "grep: ./testdata/missing: stat ./testdata/missing: no such file or directory\n" + expected
+		}
+		if buferr.String() != expected {
+			t.Errorf("%+v: expected %q got %q", test.opts, expected, buferr.String())
+		}
+		if test.opts.Quiet && bufout.Len() > 0 {
+			t.Errorf("%+v: unexpected output %q", test.opts, bufout)
+		}
+	}
+}
+
+func TestQuietErrors(t *testing.T) {
+	for _, opts := range []Options{{Quiet: true}, {Quiet: true, NoErrorMessages: true}} {
+		bufout := &bytes.Buffer{}
+		buferr := &bytes.Buffer{}
+		g := &Grepper{Options: opts, Stdout: bufout, Stderr: buferr}
+
+		if match, err := g.Search("and", []string{"./testdata/missing", "./testdata/golang"}); err != nil || !match {
+			t.Fatalf("%+v: expected match", opts)
+		}
+		if bufout.Len() > 0 {
+			t.Errorf("%+v: unexpected output %q", opts, bufout)
+		}
+
+		expected := "grep: ./testdata/missing: stat ./testdata/missing: no such file or directory\n"
+		if opts.NoErrorMessages {
+			expected = ""
+		}
+		if buferr.String() != expected {
+			t.Errorf("%+v: expected error %q got %q", opts, expected, buferr.String())
+		}
+	}
+}
+
+func TestReadPatterns(t *testing.T) {
+	patterns, err := readPatterns("./testdata/patterns", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bufout := &bytes.Buffer{}
+	g := &Grepper{Stdout: bufout, Stderr: &bytes.Buffer{}}
+
+	if match, err := g.Search(strings.Join(patterns, "\n"), []string{"./testdata/golang", "./testdata/grep"}); err != nil || !match {
+		t.Fatal("expected match")
+	}
+
+	golden, err := ioutil.ReadFile("./testdata/f patterns golang,grep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bufout.String() != string(golden) {
+		t.Fatalf("expected %q got %q", golden, bufout.String())
+	}
+
+	if _, err := readPatterns("./testdata/nonexistent", false); err == nil {
+		t.Fatal("expected error for nonexistent pattern file")
+	}
+}
+
+func TestLongLine(t *testing.T) {
+	line := strings.Repeat("x", 1<<20) + "needle"
+	input := "short\n" + line + "\nshort\n"
+
+	bufout := &bytes.Buffer{}
+	buferr := &bytes.Buffer{}
+	g := &Grepper{
+		Stdin:  strings.NewReader(input),
+		Stdout: bufout,
+		Stderr: buferr,
+	}
+
+	if match, err := g.Search("needle", nil); err != nil || !match {
+		t.Fatal("expected match")
+	}
+	if buferr.String() != "" {
+		t.Fatalf("expected stderr \"\" got %q", buferr.String())
+	}
+	if bufout.String() != line+"\n" {
+		t.Fatalf("expected the long line, got %d bytes", bufout.Len())
+	}
+}
+
+func TestColumn(t *testing.T) {
+	tests := []struct {
+		opts     Options
+		pattern  string
+		input    string
+		expected string
+	}{
+		{Options{Column: "byte"}, "foo", "ab foo foo\nbar\n", "4:ab foo foo\n"},
+		{Options{Column: "rune"}, "foo", "ab foo foo\nbar\n", "4:ab foo foo\n"},
+		{Options{Column: "byte"}, "foo", "éà€ foo\n", "9:éà€ foo\n"},
+		{Options{Column: "rune"}, "foo", "éà€ foo\n", "5:éà€ foo\n"},
+		{Options{Column: "byte", OnlyMatching: true}, "€|foo", "é€ foo €\n", "3:€\n7:foo\n11:€\n"},
+		{Options{Column: "rune", OnlyMatching: true}, "€|foo", "é€ foo €\n", "2:€\n4:foo\n8:€\n"},
+		{Options{Column: "rune", LineNumbers: true, AfterContext: 1}, "€", "é€\nfoo\n", "1:2:é€\n2-foo\n"},
+		{Options{Column: "byte", Invert: true}, "foo", "foo\nbar\n", "bar\n"},
+	}
+
+	for _, test := range tests {
+		bufout := &bytes.Buffer{}
+		g := &Grepper{
+			Options: test.opts,
+			Stdin:   strings.NewReader(test.input),
+			Stdout:  bufout,
+			Stderr:  &bytes.Buffer{},
+		}
+		if _, err := g.Search(test.pattern, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := bufout.String(); got != test.expected {
+			t.Errorf("%+v %q: expected %q got %q", test.opts, test.input, test.expected, got)
+		}
+	}
+}
+
+func TestReplace(t *testing.T) {
+	tests := []struct {
+		opts     Options
+		pattern  string
+		expected string
+	}{
+		{Options{Replace: "$2=$1"}, `(\w+):(\d+)`, "a 8080=port, 80=host\n"},
+		{Options{Replace: "${key}", OnlyMatching: true}, `(?P<key>\w+):\d+`, "port\nhost\n"},
+		{Options{Replace: "[$0]", OnlyMatching: true, LineNumbers: true}, `\d+`, "1:[8080]\n1:[80]\n"},
+		{Options{Replace: "$$1", FixedStrings: true}, "8080", "a port:$1, host:80\n"},
+		{Options{Replace: "x", Invert: true}, "port", "none\n"},
+		{Options{Replace: "${2}x", AfterContext: 1}, `(o)(r)`, "a prxt:8080, host:80\nnone\n"},
+	}
+
+	for _, test := range tests {
+		bufout := &bytes.Buffer{}
+		g := &Grepper{
+			Options: test.opts,
+			Stdin:   strings.NewReader("a port:8080, host:80\nnone\n"),
+			Stdout:  bufout,
+			Stderr:  &bytes.Buffer{},
+		}
+		if _, err := g.Search(test.pattern, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := bufout.String(); got != test.expected {
+			t.Errorf("%q %q: expected %q got %q", test.opts.Replace, test.pattern, test.expected, got)
+		}
+	}
+
+	for _, template := range []string{"$2", "${name}", "${1", "$1x", "$"} {
+		g := &Grepper{Options: Options{Replace: template}}
+		if _, err := g.compilePattern(`(\w+)`); err == nil {
+			t.Errorf("%q: expected invalid template", template)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	dir := t.TempDir()
+	text := filepath.Join(dir, "text")
+	binary := filepath.Join(dir, "binary")
+	os.WriteFile(text, []byte("port:8080\r\nhost\nport:80"), 0640)
+	os.WriteFile(binary, []byte("port:8080\x00"), 0644)
+
+	bufout := &bytes.Buffer{}
+	g := &Grepper{
+		Options: Options{Rewrite: "$2=$1", LineNumbers: true},
+		Stdout:  bufout,
+		Stderr:  &bytes.Buffer{},
+	}
+	if match, err := g.Search(`(\w+):(\d+)`, []string{text, binary}); err != nil || !match {
+		t.Fatal("expected match, got", err)
+	}
+
+	expected := text + ":1:8080=port\n" + text + ":3:80=port\n"
+	if bufout.String() != expected {
+		t.Fatalf("expected %q got %q", expected, bufout.String())
+	}
+	for name, expected := range map[string]string{
+		text:          "8080=port\r\nhost\n80=port",
+		text + ".bak": "port:8080\r\nhost\nport:80",
+		binary:        "port:8080\x00",
+	} {
+		if data, err := os.ReadFile(name); err != nil || string(data) != expected {
+			t.Errorf("%s: expected %q got %q", name, expected, data)
+		}
+	}
+	if fi, err := os.Stat(text); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("expected the mode kept, got %v", fi.Mode())
+	}
+	if _, err := os.Stat(binary + ".bak"); err == nil {
+		t.Error("expected the binary file not rewritten")
+	}
+
+	// No backup once confirmed.
+	os.Remove(text + ".bak")
+	g.Confirm = true
+	if match, err := g.Search(`(h)(ost)`, []string{text}); err != nil || !match {
+		t.Fatal("expected match, got", err)
+	}
+	if _, err := os.Stat(text + ".bak"); err == nil {
+		t.Error("expected no backup")
+	}
+	if data, _ := os.ReadFile(text); string(data) != "8080=port\r\nost=h\n80=port" {
+		t.Errorf("expected rewritten, got %q", data)
+	}
+
+	for _, paths := range [][]string{nil, {"-"}} {
+		if _, err := g.Search("port", paths); err == nil {
+			t.Errorf("%q: expected the standard input not rewritten", paths)
+		}
+	}
+}
+
+func TestNoTrailingNewline(t *testing.T) {
+	tests := []struct {
+		opts     Options
+		pattern  string
+		expected string
+	}{
+		{Options{}, "rr|ch", "cherry\n"},
+		{Options{ByteOffset: true}, "rr|ch", "21:cherry\n"},
+		{Options{ByteOffset: true, OnlyMatching: true}, "rr|ch", "21:ch\n24:rr\n"},
+		{Options{BeforeContext: 1, LineNumbers: true}, "rr|ch", "3-apricot\n4:cherry\n"},
+		{Options{Invert: true}, "a", "cherry\n"},
+		{Options{CountOnly: true}, "y$", "1\n"},
+		{Options{NullData: true}, "ch", "apple\nbanana\napricot\ncherry\x00"},
+	}
+
+	for _, test := range tests {
+		for _, mmap := range []bool{false, true} {
+			bufout := &bytes.Buffer{}
+			g := &Grepper{Options: test.opts, Stdout: bufout, Stderr: &bytes.Buffer{}}
+			g.Mmap = mmap
+
+			if _, err := g.Search(test.pattern, []string{"./testdata/nonl"}); err != nil {
+				t.Fatal(err)
+			}
+			if got := bufout.String(); got != test.expected {
+				t.Errorf("%q mmap %v: expected %q got %q", test.pattern, mmap, test.expected, got)
+			}
+		}
+	}
+
+	// The CR of the unterminated last line is stripped as well.
+	bufout := &bytes.Buffer{}
+	g := &Grepper{Stdin: strings.NewReader("a\r\nb\r"), Stdout: bufout, Stderr: &bytes.Buffer{}}
+	if _, err := g.Search("b$", nil); err != nil || bufout.String() != "b\n" {
+		t.Errorf("expected %q got %q", "b\n", bufout.String())
+	}
+}
+
+func TestExpandGlob(t *testing.T) {
+	depth := filepath.Join("testdata", "depth")
+	filter := filepath.Join("testdata", "filter")
+
+	tests := []struct {
+		glob     string
+		expected []string
+	}{
+		{filepath.Join(depth, "**"), []string{
+			filepath.Join(depth, "a", "b", "c", "three"),
+			filepath.Join(depth, "a", "b", "two"),
+			filepath.Join(depth, "a", "one"),
+			filepath.Join(depth, "top"),
+		}},
+		{filepath.Join(depth, "**", "t*"), []string{
+			filepath.Join(depth, "a", "b", "c", "three"),
+			filepath.Join(depth, "a", "b", "two"),
+			filepath.Join(depth, "top"),
+		}},
+		{filepath.Join(depth, "**", "b", "**", "t*"), []string{
+			filepath.Join(depth, "a", "b", "c", "three"),
+			filepath.Join(depth, "a", "b", "two"),
+		}},
+		{filepath.Join("testdata", "**", "filter", "*.c"), []string{
+			filepath.Join(filter, "a.c"),
+			filepath.Join(filter, "a_test.c"),
+		}},
+		{filepath.Join(filter, "**", "*.c"), []string{
+			filepath.Join(filter, "a.c"),
+			filepath.Join(filter, "a_test.c"),
+			filepath.Join(filter, "sub", "c.c"),
+		}},
+		{filepath.Join(filter, "*", "*.c"), []string{
+			filepath.Join(filter, "sub", "c.c"),
+		}},
+		{filepath.Join(filter, "**", "*.go"), nil},
+		// The low byte of the U+012F is of the slash.
+		{filepath.Join(depth, "**", "t[oį]p"), []string{
+			filepath.Join(depth, "top"),
+		}},
+		{filepath.Join(depth, "**", "įtop"), nil},
+	}
+
+	for _, test := range tests {
+		names, err := expandGlob(test.glob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%s: expected %q got %q", test.glob, test.expected, names)
+		}
+	}
+
+	if _, err := expandGlob(filepath.Join(filter, "**", "[")); err == nil {
+		t.Error("expected syntax error")
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	input := "foo short\nfoo" + strings.Repeat("x", 200000) + "\nfoo end"
+	name := filepath.Join(t.TempDir(), "long")
+	if err := ioutil.WriteFile(name, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		opts     Options
+		expected string
+		stderr   string
+	}{
+		{
+			Options{MaxLineLength: 10, LineNumbers: true, ByteOffset: true},
+			"1:0:foo short\n3:200014:foo end\n",
+			"grep: %s:2: skipped, longer than 10 bytes\n",
+		},
+		{
+			Options{MaxLineLength: 10, LineNumbers: true, ByteOffset: true, Truncate: true},
+			"1:0:foo short\n2:10:fooxxxxxxx\n3:200014:foo end\n",
+			"",
+		},
+		{
+			Options{MaxLineLength: 10, NoErrorMessages: true, CountOnly: true},
+			"2\n",
+			"",
+		},
+		{
+			Options{MaxLineLength: 7, Truncate: true},
+			"foo sho\nfooxxxx\nfoo end\n",
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		for _, mmap := range []bool{false, true} {
+			for _, path := range []string{"-", name} {
+				bufout := &bytes.Buffer{}
+				buferr := &bytes.Buffer{}
+				g := &Grepper{Options: test.opts, Stdin: strings.NewReader(input), Stdout: bufout, Stderr: buferr}
+				g.Mmap = mmap
+
+				if match, err := g.Search("foo", []string{path}); err != nil || !match {
+					t.Fatalf("%+v: expected match", test.opts)
+				}
+				if bufout.String() != test.expected {
+					t.Fatalf("%+v %s: expected %q got %q", test.opts, path, test.expected, bufout.String())
+				}
+				stderr := test.stderr
+				if stderr != "" {
+					stderr = fmt.Sprintf(stderr, path)
+				}
+				if path == "-" {
+					stderr = strings.Replace(stderr, "-:", stdinLabel+":", 1)
+				}
+				if buferr.String() != stderr {
+					t.Fatalf("%+v %s: expected stderr %q got %q", test.opts, path, stderr, buferr.String())
+				}
+			}
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	tests := []struct {
+		opts     Options
+		pattern  string
+		expected []jsonMatch
+	}{
+		{Options{}, "and|<a>", []jsonMatch{
+			{"./testdata/golang", 4, 35, "Go is expressive, concise, clean, and efficient. Its concurrency mechanisms", "and"},
+			{"./testdata/golang", 5, 67, "make it easy to write programs that get the most out of multicore and networked", "and"},
+			{"./testdata/golang", 6, 56, "machines, while its novel type system enables flexible and modular program", "and"},
+			{"./testdata/golang", 8, 20, "garbage collection and the power of run-time reflection. It's a fast,", "and"},
+			{"stdin", 1, 1, "<a> & \"b\"", "<a>"},
+		}},
+		{Options{OnlyMatching: true, AfterContext: 1}, "^p.*e|t.e", []jsonMatch{
+			{"./testdata/golang", 2, 1, "productive.", "productive"},
+			{"./testdata/golang", 5, 7, "make it easy to write programs that get the most out of multicore and networked", "t e"},
+			{"./testdata/golang", 5, 41, "make it easy to write programs that get the most out of multicore and networked", "the"},
+			{"./testdata/golang", 7, 59, "construction. Go compiles quickly to machine code yet has the convenience of", "the"},
+			{"./testdata/golang", 8, 24, "garbage collection and the power of run-time reflection. It's a fast,", "the"},
+		}},
+		{Options{Invert: true}, "[a-z]", []jsonMatch{
+			{"./testdata/golang", 3, 0, "", ""},
+		}},
+	}
+
+	for _, test := range tests {
+		bufout := &bytes.Buffer{}
+		g := &Grepper{
+			Options: test.opts,
+			Stdin:   strings.NewReader("<a> & \"b\"\n"),
+			Stdout:  bufout,
+			Stderr:  &bytes.Buffer{},
+		}
+		g.JSON = true
+		g.Label = "stdin"
+
+		if match, err := g.Search(test.pattern, []string{"./testdata/golang", "-"}); err != nil || !match {
+			t.Fatalf("%q: expected match", test.pattern)
+		}
+
+		var got []jsonMatch
+		dec := json.NewDecoder(bufout)
+		for dec.More() {
+			var m jsonMatch
+			if err := dec.Decode(&m); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, m)
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%q: expected\n%+v\ngot\n%+v", test.pattern, test.expected, got)
+		}
+	}
+
+	// One object per line, the HTML characters not escaped.
+	g := &Grepper{Options: Options{JSON: true}, Stdin: strings.NewReader("<a>\n"), Stdout: &bytes.Buffer{}}
+	if _, err := g.Search("a", nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"file":"(standard input)","line":1,"column":2,"text":"<a>","match":"a"}` + "\n"
+	if got := g.Stdout.(*bytes.Buffer).String(); got != expected {
+		t.Fatalf("expected %q got %q", expected, got)
+	}
+
+	// The counts and names are JSON objects too.
+	names := []string{"./testdata/golang", "./testdata/grep"}
+	for _, test := range []struct {
+		opts     Options
+		pattern  string
+		expected string
+	}{
+		{Options{CountOnly: true}, "the", `{"file":"./testdata/golang","count":3}` + "\n" + `{"file":"./testdata/grep","count":26}` + "\n"},
+		{Options{CountTotal: true}, "the", `{"file":"./testdata/golang","count":3}` + "\n" + `{"file":"./testdata/grep","count":26}` + "\n" + `{"count":29}` + "\n"},
+		{Options{FilesWithMatch: true}, "the", `{"file":"./testdata/golang"}` + "\n" + `{"file":"./testdata/grep"}` + "\n"},
+		{Options{FilesWithoutMatch: true}, "nomatchforsure", `{"file":"./testdata/golang"}` + "\n" + `{"file":"./testdata/grep"}` + "\n"},
+	} {
+		bufout := &bytes.Buffer{}
+		g := &Grepper{Options: test.opts, Stdout: bufout, Stderr: &bytes.Buffer{}}
+		g.JSON = true
+		if _, err := g.Search(test.pattern, names); err != nil {
+			t.Fatal(err)
+		}
+		if bufout.String() != test.expected {
+			t.Errorf("%+v: expected %q got %q", test.opts, test.expected, bufout.String())
+		}
+	}
+}
+
+func TestNullData(t *testing.T) {
+	bufout := &bytes.Buffer{}
+	g := &Grepper{
+		Options: Options{NullData: true, LineNumbers: true},
+		Stdin:   strings.NewReader("foo\nbar\x00baz\x00qux foo\x00"),
+		Stdout:  bufout,
+		Stderr:  &bytes.Buffer{},
+	}
+
+	if match, err := g.Search("foo", nil); err != nil || !match {
+		t.Fatal("expected match")
+	}
+
+	expected := "1:foo\nbar\x003:qux foo\x00"
+	if bufout.String() != expected {
+		t.Fatalf("expected %q got %q", expected, bufout.String())
+	}
+}
+
+func TestLineTerminator(t *testing.T) {
+	tests := []struct {
+		terminator string
+		opts       Options
+		expected   string
+	}{
+		{"\x1e", Options{LineNumbers: true}, "1:foo\nbar\x1e3:qux foo\x1e"},
+		{`\x1e`, Options{NullData: true, ByteOffset: true}, "0:foo\nbar\x1e12:qux foo\x1e"},
+		{`\x1e`, Options{OnlyMatching: true}, "foo\x1efoo\x1e"},
+	}
+
+	for _, test := range tests {
+		bufout := &bytes.Buffer{}
+		g := &Grepper{
+			Options: test.opts,
+			Stdin:   strings.NewReader("foo\nbar\x1ebaz\x1equx foo\x1e"),
+			Stdout:  bufout,
+			Stderr:  &bytes.Buffer{},
+		}
+		if err := g.LineTerminator.Set(test.terminator); err != nil {
+			t.Fatal(err)
+		}
+
+		if match, err := g.Search("foo", nil); err != nil || !match {
+			t.Fatalf("%q: expected match", test.terminator)
+		}
+		if bufout.String() != test.expected {
+			t.Fatalf("%q: expected %q got %q", test.terminator, test.expected, bufout.String())
+		}
+	}
+
+	var term terminatorFlag
+	for _, bad := range []string{"", "ab", `\x1e\x1e`, `\q`} {
+		if err := term.Set(bad); err == nil {
+			t.Fatalf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	tests := []struct {
+		encoding string
+		input    string
+		expected string
+	}{
+		{"utf-8", "a\xffb\n", "a\uFFFDb\n"},
+		{"latin1", "a\xffb\n", "aÿb\n"},
+		{"utf-16le", "a\x00\x3d\xd8\x00\xdeb\x00\n\x00", "a😀b\n"},
+		{"utf-16le", "a\x00\x00\xdcb\x00\n\x00", "a\uFFFDb\n"},
+		{"utf-16le", "a\x00\x3d\xd8b\x00\n\x00", "a\uFFFDb\n"},
+		{"utf-16le", "a\x00b\x00c", "ab\uFFFD\n"},
+		{"utf-16", "\xff\xfea\x00b\x00", "ab\n"},
+		{"utf-16", "\xfe\xff\x00a\x00b", "ab\n"},
+		{"utf-16", "\x00a\x00b", "ab\n"},
+		{"auto", "\xef\xbb\xbfa\xffb\n", "a\uFFFDb\n"},
+		{"auto", "\xff\xfea\x00b\x00", "ab\n"},
+		{"auto", "\xfe\xff\x00a\x00b", "ab\n"},
+		{"auto", "\xff\xfe\x00\x00a\x00\x00\x00\x00\xf6\x01\x00", "a😀\n"},
+		{"auto", "\x00\x00\xfe\xff\x00\x00\x00a\x00\x00\xd8\x00\x00\x11\x00\x00\x00", "a\uFFFD\uFFFD\uFFFD\n"},
+		{"auto", "a\xffb\n", "a\xffb\n"},
+	}
+
+	for _, test := range tests {
+		bufout := &bytes.Buffer{}
+		g := &Grepper{
+			Options: Options{Text: true},
+			Stdin:   strings.NewReader(test.input),
+			Stdout:  bufout,
+			Stderr:  &bytes.Buffer{},
+		}
+		if err := g.Encoding.Set(test.encoding); err != nil {
+			t.Fatal(err)
+		}
+
+		if match, err := g.Search("a", nil); err != nil || !match {
+			t.Fatalf("%s %q: expected match", test.encoding, test.input)
+		}
+		if bufout.String() != test.expected {
+			t.Fatalf("%s %q: expected %q got %q", test.encoding, test.input, test.expected, bufout.String())
+		}
+	}
+
+	var e encodingFlag
+	if err := e.Set("ebcdic"); err == nil {
+		t.Fatal("expected error for unknown encoding")
+	}
+}
+
+func TestBinaryCRLF(t *testing.T) {
+	tests := []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{}, "foo bar\nbaz foo\nfoo\n"},
+		{Options{Binary: true}, "foo bar\r\nbaz foo\r\nfoo\r\n"},
+	}
+
+	for _, test := range tests {
+		bufout := &bytes.Buffer{}
+		g := &Grepper{Options: test.opts, Stdout: bufout, Stderr: &bytes.Buffer{}}
+
+		if match, err := g.Search("foo", []string{"./testdata/crlf"}); err != nil || !match {
+			t.Fatal("expected match")
+		}
+
+		if bufout.String() != test.expected {
+			t.Fatalf("expected %q got %q", test.expected, bufout.String())
+		}
+	}
+}
+
+func TestMmap(t *testing.T) {
+	root := t.TempDir()
+	name := filepath.Join(root, "lines")
+	if err := ioutil.WriteFile(name, []byte("foo bar\r\nbaz\x00foo\n\nfoo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(root, "empty")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []Options{
+		{Text: true, LineNumbers: true, ByteOffset: true},
+		{Text: true, Binary: true},
+		{Text: true, Invert: true, Context: 1},
+		{NullData: true, ByteOffset: true},
+		{},
+		{SkipBinary: true},
+	} {
+		var expected string
+		for _, mmap := range []bool{false, true} {
+			bufout := &bytes.Buffer{}
+			g := &Grepper{Options: opts, Stdout: bufout, Stderr: &bytes.Buffer{}}
+			g.Mmap = mmap
+
+			if _, err := g.Search("foo", []string{name, empty}); err != nil {
+				t.Fatal(err)
+			}
+			if !mmap {
+				expected = bufout.String()
+			} else if bufout.String() != expected {
+				t.Fatalf("%+v: expected %q got %q", opts, expected, bufout.String())
+			}
+		}
+	}
+}
+
+func TestNullName(t *testing.T) {
+	tests := []struct {
+		opts     Options
+		expected string
+	}{
+		{
+			Options{NullName: true, FilesWithMatch: true},
+			"./testdata/fixed\x00./testdata/words\x00",
+		},
+		{
+			Options{NullName: true, CountOnly: true},
+			"./testdata/fixed\x002\n./testdata/words\x001\n",
+		},
+		{
+			Options{NullName: true, LineNumbers: true},
+			"./testdata/fixed\x005:func()\n./testdata/fixed\x006:func\n./testdata/words\x003:concatenate\n",
+		},
+		{
+			Options{NullName: true, OnlyMatching: true},
+			"./testdata/fixed\x00func\x00./testdata/fixed\x00func\x00./testdata/words\x00concat\x00",
+		},
+		{
+			Options{NullName: true, OnlyMatching: true, LineNumbers: true, LineBuffered: true},
+			"./testdata/fixed\x005:func\x00./testdata/fixed\x006:func\x00./testdata/words\x003:concat\x00",
+		},
+	}
+
+	for _, test := range tests {
+		bufout := &bytes.Buffer{}
+		g := &Grepper{Options: test.opts, Stdout: bufout, Stderr: &bytes.Buffer{}}
+
+		if match, err := g.Search("func|concat", []string{"./testdata/fixed", "./testdata/words"}); err != nil || !match {
+			t.Fatal("expected match")
+		}
+
+		if bufout.String() != test.expected {
+			t.Fatalf("expected %q got %q", test.expected, bufout.String())
+		}
+	}
+}
+
+func TestGzip(t *testing.T) {
+	bufout := &bytes.Buffer{}
+	buferr := &bytes.Buffer{}
+	g := &Grepper{
+		Options: Options{Gzip: true},
+		Stdout:  bufout,
+		Stderr:  buferr,
+	}
+
+	if match, err := g.Search("error", []string{"./testdata/corrupt.gz", "./testdata/log"}); err != nil || !match {
+		t.Fatal("expected match")
+	}
+
+	expected := "./testdata/log:Jan 01 00:00:02 error: disk full\n./testdata/log:Jan 01 00:00:04 error: disk full\n"
+	if bufout.String() != expected {
+		t.Fatalf("expected %q got %q", expected, bufout.String())
+	}
+
+	expected = "grep: ./testdata/corrupt.gz: unexpected EOF\n"
+	if buferr.String() != expected {
+		t.Fatalf("expected stderr %q got %q", expected, buferr.String())
+	}
+}
+
+// flushRecorder records the output written by the time of each flush.
+type flushRecorder struct {
+	bytes.Buffer
+	flushed []string
+}
+
+func (r *flushRecorder) Flush() error {
+	r.flushed = append(r.flushed, r.String())
+	return nil
+}
+
+func TestLineBuffered(t *testing.T) {
+	lines := []string{
+		"./testdata/golang:5:make it easy to write programs that get the most out of multicore and networked\n",
+		"./testdata/grep:35:programs. Before grep existed as a separate command, the same effect might have\n",
+	}
+
+	for _, lineBuffered := range []bool{false, true} {
+		out := &flushRecorder{}
+		g := &Grepper{
+			Options: Options{LineBuffered: lineBuffered, LineNumbers: true, Jobs: 1},
+			Stdout:  out,
+			Stderr:  &bytes.Buffer{},
+		}
+
+		if match, err := g.Search("multicore|Before grep", []string{"./testdata/golang", "./testdata/grep"}); err != nil || !match {
+			t.Fatal("expected match")
+		}
+
+		if out.String() != strings.Join(lines, "") {
+			t.Fatalf("expected %q got %q", strings.Join(lines, ""), out.String())
+		}
+
+		if !lineBuffered {
+			if len(out.flushed) != 0 {
+				t.Fatalf("expected no flush got %q", out.flushed)
+			}
+			continue
+		}
+
+		// Flushed after each line and at the end of the search.
+		if len(out.flushed) != len(lines)+1 {
+			t.Fatalf("expected %d flushes got %q", len(lines)+1, out.flushed)
+		}
+		for i := range lines {
+			if expected := strings.Join(lines[:i+1], ""); out.flushed[i] != expected {
+				t.Fatalf("expected flushed %q got %q", expected, out.flushed[i])
+			}
+		}
+	}
+}
+
+func TestParseColors(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected colors
+	}{
+		{"", defaultColors},
+		{"ms=01;32", colors{"01;32", "35", "32", "32", "36"}},
+		{"mt=04:fn=34:ln=:bn=33:se=1;36", colors{"04", "34", "", "33", "1;36"}},
+		{"sl=1:cx=2:rv:ne:fn=", colors{"01;31", "", "32", "32", "36"}},
+	}
+
+	for _, test := range tests {
+		if c := parseColors(test.spec); c != test.expected {
+			t.Fatalf("%q: expected %+v got %+v", test.spec, test.expected, c)
+		}
+	}
+}
+
+func TestColors(t *testing.T) {
+	bufout := &bytes.Buffer{}
+	g := &Grepper{
+		Options: Options{
+			Color:        "always",
+			Colors:       "ms=04:fn=34:ln=33:bn=35:se=36",
+			WithFilename: true,
+			LineNumbers:  true,
+			ByteOffset:   true,
+			AfterContext: 1,
+		},
+		Stdout: bufout,
+		Stderr: &bytes.Buffer{},
+	}
+
+	if match, err := g.Search("hyphen|Thompson", []string{"./testdata/grep"}); err != nil || !match {
+		t.Fatal("expected match")
+	}
+
+	prefix := func(number, offset, sep string) string {
+		sep = "\033[36m" + sep + "\033[0m"
+		return "\033[34m./testdata/grep\033[0m" + sep + "\033[33m" + number + "\033[0m" + sep + "\033[35m" + offset + "\033[0m" + sep
+	}
+	expected := prefix("2", "8", ":") + "Grep was created by Ken \033[04mThompson\033[0m as a standalone application adapted from the\n" +
+		prefix("3", "86", "-") + "regular expression parser he had written for ed (which he also created). In ed,\n" +
+		"\033[36m--\033[0m\n" +
+		prefix("48", "2318", ":") + "i.e. surrounded by white space or \033[04mhyphen\033[0ms, may be accomplished with the option\n" +
+		prefix("49", "2397", "-") + "flag w.\n"
+	if bufout.String() != expected {
+		t.Fatalf("expected %q got %q", expected, bufout.String())
+	}
+}
+
+func TestFilesFrom(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "list")
+	if err := ioutil.WriteFile(list, []byte("./testdata/words\x00\x00./testdata/fixed\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bufout := &bytes.Buffer{}
+	g := &Grepper{
+		Options: Options{FilesFrom: list, NullData: true, CountOnly: true},
+		Stdout:  bufout,
+		Stderr:  &bytes.Buffer{},
+	}
+
+	if match, err := g.Search("cat|func", nil); err != nil || !match {
+		t.Fatal("expected match")
+	}
+
+	expected := "./testdata/words:1\n./testdata/fixed:1\n"
+	if bufout.String() != expected {
+		t.Fatalf("expected %q got %q", expected, bufout.String())
+	}
+
+	g.FilesFrom = "./testdata/nonexistent"
+	if _, err := g.Search("cat", nil); err == nil {
+		t.Fatal("expected error for nonexistent file list")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected int64
+		err      bool
+	}{
+		{"0", 0, false},
+		{"100", 100, false},
+		{"10k", 10 << 10, false},
+		{"10K", 10 << 10, false},
+		{"10M", 10 << 20, false},
+		{"1G", 1 << 30, false},
+		{"2T", 2 << 40, false},
+		{"", 0, true},
+		{"M", 0, true},
+		{"-1", 0, true},
+		{"1.5M", 0, true},
+		{"10X", 0, true},
+		{"9999999999T", 0, true},
+	}
+
+	for _, test := range tests {
+		n, err := parseSize(test.s)
+		if (err != nil) != test.err {
+			t.Fatalf("%q: expected error %v got %v", test.s, test.err, err)
+		}
+		if n != test.expected {
+			t.Fatalf("%q: expected %d got %d", test.s, test.expected, n)
+		}
+	}
+}
+
+func TestMaxFilesize(t *testing.T) {
+	root := t.TempDir()
+	small := filepath.Join(root, "small")
+	large := filepath.Join(root, "large")
+	if err := ioutil.WriteFile(small, []byte("foo foo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(large, []byte("foo foo!\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		opts     Options
+		paths    []string
+		expected string
+	}{
+		{
+			Options{MaxFilesize: 8},
+			[]string{small, large},
+			small + ":foo foo\n",
+		},
+		{
+			Options{MaxFilesize: 8, Recursive: true},
+			[]string{root},
+			small + ":foo foo\n",
+		},
+	}
+
+	for _, test := range tests {
+		bufout := &bytes.Buffer{}
+		buferr := &bytes.Buffer{}
+		g := &Grepper{Options: test.opts, Stdout: bufout, Stderr: buferr}
+
+		if match, err := g.Search("foo", test.paths); err != nil || !match {
+			t.Fatal("expected match")
+		}
+
+		if bufout.String() != test.expected {
+			t.Fatalf("expected %q got %q", test.expected, bufout.String())
+		}
+
+		expected := "grep: " + large + ": skipped, larger than 8 bytes\n"
+		if buferr.String() != expected {
+			t.Fatalf("expected stderr %q got %q", expected, buferr.String())
+		}
+	}
+}
+
+func TestTranslateBRE(t *testing.T) {
+	tests := []struct {
+		bre string
+		re  string
+	}{
+		{`a\{2,3\}`, `a{2,3}`},
+		{`\(ab\)*c`, `(ab)*c`},
+		{`a\+b\?`, `a+b?`},
+		{`cat\|dog`, `cat|dog`},
+		{`f(x)`, `f\(x\)`},
+		{`a{2}|b+c?`, `a\{2\}\|b\+c\?`},
+		{`*a`, `\*a`},
+		{`^*a`, `^\*a`},
+		{`\(*a\)`, `(\*a)`},
+		{`a^b$c`, `a\^b\$c`},
+		{`^ab$`, `^ab$`},
+		{`\(a$\)`, `(a$)`},
+		{`\<cat\>`, `\bcat\b`},
+		{`[\(]`, `[\\(]`},
+		{`[]a]`, `[\]a]`},
+		{`[^]a]`, `[^\]a]`},
+		{`[[:alpha:]_]`, `[[:alpha:]_]`},
+		{`a\.b\*`, `a\.b\*`},
+	}
+
+	for _, test := range tests {
+		if re := translateBRE(test.bre); re != test.re {
+			t.Errorf("translateBRE(%q) expected %q got %q", test.bre, test.re, re)
+		}
+	}
+}
+
+// vowelMatcher is a fake Matcher matching the lines starting with a vowel.
+type vowelMatcher struct{}
+
+func (vowelMatcher) MatchString(s string) bool {
+	return s != "" && strings.ContainsRune("aeiouAEIOU", rune(s[0]))
+}
+
+func (m vowelMatcher) FindAllStringIndex(s string, n int) [][]int {
+	if m.MatchString(s) {
+		return [][]int{{0, 1}}
+	}
+	return nil
+}
+
+func TestMatcher(t *testing.T) {
+	bufout := &bytes.Buffer{}
+	g := &Grepper{
+		Options: Options{OnlyMatching: true, LineNumbers: true},
+		stdout:  bufout,
+	}
+	g.format = g.formatter()
+
+	if match, err := g.grepFile("", strings.NewReader("apple\nbanana\norange\n"), vowelMatcher{}); err != nil || !match {
+		t.Fatal("expected match")
+	}
+
+	expected := "1:a\n3:o\n"
+	if bufout.String() != expected {
+		t.Fatalf("expected %q got %q", expected, bufout.String())
+	}
+}
+
+func TestPerl(t *testing.T) {
+	defer func() { perlCompile = nil }()
+
+	g := &Grepper{Options: Options{Perl: true, IgnoreCase: true}}
+
+	if _, err := g.compilePattern("a(?=b)"); err == nil {
+		t.Fatal("expected error without Perl-compatible engine")
+	}
+
+	var compiled string
+	perlCompile = func(expr string) (Matcher, error) {
+		compiled = expr
+		return vowelMatcher{}, nil
+	}
+
+	m, err := g.compilePattern("a(?=b)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(vowelMatcher); !ok {
+		t.Fatalf("expected the Matcher of the engine, got %T", m)
+	}
+	if compiled != "(?i)a(?=b)" {
+		t.Fatalf("expected the engine to compile %q got %q", "(?i)a(?=b)", compiled)
+	}
+}
+
+func TestGrepError(t *testing.T) {
+	g := &Grepper{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+
+	if _, err := g.Search("(", []string{"./testdata/golang"}); err == nil {
+		t.Fatal("expected error for invalid pattern")
+	}
+	if _, err := g.Search("and", []string{"./testdata/golang"}); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	g.Multiline, g.Invert = true, true
+	if _, err := g.Search("and", []string{"./testdata/golang"}); err == nil {
+		t.Fatal("expected error for --multiline with -v")
+	}
+
+	g.Options = Options{Perl: true, Posix: true}
+	if _, err := g.Search("and", []string{"./testdata/golang"}); err == nil {
+		t.Fatal("expected error for --posix with -P")
+	}
+}
+
+func TestSearchStream(t *testing.T) {
+	tests := []struct {
+		opts Options
+		want []Result
+	}{
+		{Options{}, []Result{
+			{"./testdata/golang", 1, 0, "The Go programming language is an open source project to make programmers more", [][]int{{4, 6}}, false, 0},
+			{"./testdata/golang", 4, 92, "Go is expressive, concise, clean, and efficient. Its concurrency mechanisms", [][]int{{0, 2}}, false, 0},
+			{"./testdata/golang", 7, 323, "construction. Go compiles quickly to machine code yet has the convenience of", [][]int{{14, 16}}, false, 0},
+		}},
+		{Options{AfterContext: 1, MaxCount: 1}, []Result{
+			{"./testdata/golang", 1, 0, "The Go programming language is an open source project to make programmers more", [][]int{{4, 6}}, false, 0},
+			{"./testdata/golang", 2, 79, "productive.", nil, true, 0},
+		}},
+		{Options{OnlyMatching: true, CountOnly: true}, []Result{
+			{"./testdata/golang", 1, 4, "Go", [][]int{{0, 2}}, false, 0},
+			{"./testdata/golang", 4, 92, "Go", [][]int{{0, 2}}, false, 0},
+			{"./testdata/golang", 7, 337, "Go", [][]int{{0, 2}}, false, 0},
+		}},
+	}
+
+	for _, test := range tests {
+		stderr := &bytes.Buffer{}
+		g := &Grepper{Options: test.opts, Stdout: &bytes.Buffer{}, Stderr: stderr}
+
+		results, err := g.SearchStream(context.Background(), "Go", []string{"./testdata/golang"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []Result
+		for r := range results {
+			got = append(got, r)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v: expected results\n%+v\ngot\n%+v", test.opts, test.want, got)
+		}
+		if stderr.Len() > 0 {
+			t.Errorf("%+v: unexpected stderr %q", test.opts, stderr)
+		}
+	}
+
+	g := &Grepper{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+	if _, err := g.SearchStream(context.Background(), "(", nil); err == nil {
+		t.Fatal("expected error for invalid pattern")
+	}
+}
+
+func TestSearchStreamCancel(t *testing.T) {
+	input := strings.Repeat("match\n", 100000)
+	in := &countingReader{r: strings.NewReader(input)}
+	g := &Grepper{Stdin: in, Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results, err := g.SearchStream(ctx, "match", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-results
+	if r.Name != stdinLabel || r.Number != 1 || r.Text != "match" {
+		t.Fatalf("unexpected first result %+v", r)
+	}
+	cancel()
+
+	n := 1
+	for range results {
+		n++
+	}
+	if n > 2 {
+		t.Fatalf("expected the search stopped, got %d results", n)
+	}
+	if in.n == len(input) {
+		t.Fatal("expected the search stopped before reading all input")
+	}
+}
+
+func BenchmarkSearch(b *testing.B) {
+	name := filepath.Join(b.TempDir(), "large")
+	line := "The Go programming language is an open source project to make programmers more\n"
+	if err := ioutil.WriteFile(name, []byte(strings.Repeat(line, 100000)), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%v", mmap), func(b *testing.B) {
+			g := &Grepper{Options: Options{CountOnly: true, Mmap: mmap}, Stdout: ioutil.Discard, Stderr: ioutil.Discard}
+			for i := 0; i < b.N; i++ {
+				if _, err := g.Search("open source", []string{name}); err != nil {
+					b.Fatal(err)
+				}
 			}
-		} else {
-			goldenFile, err := os.Open(test.pathStdout)
+		})
+	}
+}
+
+// BenchmarkGrepFile searches 8MB of log lines, few or all of them matching.
+// Matching the bytes of the lines, not converting the not matching ones to
+// strings, took the sparse one from about 560MB/s and 152k allocations to
+// about 830MB/s and 7 allocations per search.
+func BenchmarkGrepFile(b *testing.B) {
+	var input strings.Builder
+	for i := 0; input.Len() < 8<<20; i++ {
+		fmt.Fprintf(&input, "2024-01-02 15:04:05 INFO request %d served in %dms\n", i, i%500)
+	}
+
+	for _, bench := range []struct {
+		name    string
+		pattern string
+	}{
+		{"sparse", "ERROR"},
+		{"heavy", "served"},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			g := &Grepper{stdout: ioutil.Discard, stderr: ioutil.Discard}
+			g.format = g.formatter()
+			re, err := g.compilePattern(bench.pattern)
 			if err != nil {
-				t.Fatal(err)
+				b.Fatal(err)
 			}
-			defer goldenFile.Close()
-			goldenScan := bufio.NewScanner(goldenFile)
-			actualScan := bufio.NewScanner(bufout)
 
-			for goldenScan.Scan() {
-				if !actualScan.Scan() {
-					t.Fatal("context", test.pathStdout, "unexpected eof")
-				}
+			b.SetBytes(int64(input.Len()))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				g.grepFile("", strings.NewReader(input.String()), re)
+			}
+		})
+	}
+}
 
-				if goldenScan.Text() != actualScan.Text() {
-					t.Fatalf("context %q expected %q got %q", test.pathStdout, goldenScan.Text(), actualScan.Text())
+func TestQuery(t *testing.T) {
+	q, err := Compile("PROGRAM", Options{IgnoreCase: true, CountOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		paths    []string
+		expected string
+	}{
+		{[]string{"./testdata/golang"}, "3\n"},
+		{[]string{"./testdata/grep"}, "2\n"},
+		{[]string{"./testdata/golang", "./testdata/grep"}, "./testdata/golang:3\n./testdata/grep:2\n"},
+	}
+
+	// The query is searched for by several Greppers at once.
+	done := make(chan struct{})
+	for _, test := range tests {
+		test := test
+		go func() {
+			defer func() { done <- struct{}{} }()
+
+			bufout := &bytes.Buffer{}
+			g := &Grepper{Stdout: bufout, Stderr: &bytes.Buffer{}}
+			for i := 0; i < 3; i++ {
+				bufout.Reset()
+				if match, err := g.SearchQuery(context.Background(), q, test.paths); err != nil || !match {
+					t.Errorf("%v: expected match, got error %v", test.paths, err)
+				}
+				if bufout.String() != test.expected {
+					t.Errorf("%v: expected %q got %q", test.paths, test.expected, bufout.String())
 				}
 			}
+		}()
+	}
+	for range tests {
+		<-done
+	}
 
-			if err := goldenScan.Err(); err != nil {
-				t.Fatal(err)
-			}
+	if !q.Options().IgnoreCase {
+		t.Error("expected the options of the query")
+	}
+	if _, err := Compile("(", Options{}); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
 
-			if err := actualScan.Err(); err != nil {
-				t.Fatal("unexpected error", err)
-			}
+func TestAhoCorasick(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	word := func(max int) string {
+		b := make([]byte, 1+rnd.Intn(max))
+		for i := range b {
+			b[i] = "abc"[rnd.Intn(3)]
 		}
+		return string(b)
+	}
+
+	for i := 0; i < 200; i++ {
+		strs := make([]string, 1+rnd.Intn(8))
+		for j := range strs {
+			strs[j] = word(4)
+		}
+		g := &Grepper{Options: Options{FixedStrings: true}}
+		re := regexp.MustCompile(g.patternExpr(strs))
+		ac := newAhoCorasick(strs)
 
-		if Flags.NoErrorMessages {
-			if stderr != ioutil.Discard {
-				t.Fatal("expected stderr set to ioutil.Discard if NoErrorMessages flag")
+		for j := 0; j < 20; j++ {
+			text := word(30)
+			if ac.MatchString(text) != re.MatchString(text) || ac.Match([]byte(text)) != re.MatchString(text) {
+				t.Fatalf("%q in %q: expected match %v", strs, text, re.MatchString(text))
+			}
+			for _, n := range []int{-1, 1, 2} {
+				expected := re.FindAllStringIndex(text, n)
+				if got := ac.FindAllStringIndex(text, n); !reflect.DeepEqual(got, expected) {
+					t.Fatalf("%q in %q: expected %v got %v", strs, text, expected, got)
+				}
 			}
 		}
+	}
+
+	// Used for many fixed strings, unless modified by the flags.
+	strs := make([]string, ahoCorasickMin)
+	for i := range strs {
+		strs[i] = fmt.Sprintf("word%d", i)
+	}
+	pattern := strings.Join(strs, "\n")
+	for _, test := range []struct {
+		opts  Options
+		fixed bool
+	}{
+		{Options{FixedStrings: true}, true},
+		{Options{FixedStrings: true, IgnoreCase: true}, false},
+		{Options{FixedStrings: true, WordMatch: true}, false},
+		{Options{}, false},
+	} {
+		g := &Grepper{Options: test.opts}
+		m, err := g.compilePattern(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.(*ahoCorasick); ok != test.fixed {
+			t.Fatalf("%+v: expected Aho-Corasick %v", test.opts, test.fixed)
+		}
+	}
+	g := &Grepper{Options: Options{FixedStrings: true}}
+	if m, _ := g.compilePattern(pattern + "\n"); m.(*regexp.Regexp) == nil {
+		t.Fatal("expected regular expression for an empty string")
+	}
+}
+
+// BenchmarkFixedStrings matches 1000 random words against 16KB of log lines,
+// by their alternation in a regular expression or by the Aho-Corasick
+// automaton. The automaton matched at 65 MB/s, the regular expression at
+// 0.02 MB/s.
+func BenchmarkFixedStrings(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	strs := make([]string, 1000)
+	for i := range strs {
+		b := make([]byte, 6+rnd.Intn(7))
+		for j := range b {
+			b[j] = byte('a' + rnd.Intn(26))
+		}
+		strs[i] = string(b)
+	}
 
-		if Flags.Quiet {
-			if stderr != ioutil.Discard {
-				t.Fatal("expected stderr set to ioutil.Discard if -q")
+	var input strings.Builder
+	for i := 0; input.Len() < 1<<14; i++ {
+		fmt.Fprintf(&input, "2024-01-02 15:04:05 INFO request from host-%d.example.com served\n", i)
+	}
+	lines := strings.Split(input.String(), "\n")
+
+	g := &Grepper{Options: Options{FixedStrings: true}}
+	re := regexp.MustCompile(g.patternExpr(strs))
+
+	for _, bench := range []struct {
+		name string
+		m    Matcher
+	}{
+		{"regexp", re},
+		{"aho-corasick", newAhoCorasick(strs)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(int64(input.Len()))
+			for i := 0; i < b.N; i++ {
+				for _, line := range lines {
+					bench.m.MatchString(line)
+				}
 			}
-			if stdout != ioutil.Discard {
-				t.Fatal("expected stdout set to ioutil.Discard if -q")
+		})
+	}
+}
+
+func TestWordExpr(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{`foo`, `\b(?:foo)\b`},
+		{`^foo`, `(?:^foo)\b`},
+		{`foo$`, `\b(?:foo$)`},
+		{`^foo$`, `(?:^foo$)`},
+		{`foo\$`, `\b(?:foo\$)\b`},
+		{`foo\\$`, `\b(?:foo\\$)`},
+	}
+
+	for _, test := range tests {
+		if got := wordExpr(test.expr); got != test.expected {
+			t.Errorf("%s: expected %s got %s", test.expr, test.expected, got)
+		}
+	}
+}
+
+func TestOutput(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "input"), []byte("foo\nbar\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(dir, "output")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buferr := &bytes.Buffer{}
+	g := &Grepper{
+		Options: Options{Recursive: true},
+		Stdout:  f,
+		Stderr:  buferr,
+	}
+	if match, err := g.Search("foo", []string{dir}); err != nil || !match {
+		t.Fatal("expected match")
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := filepath.Join(dir, "input") + ":foo\n"
+	if string(data) != expected {
+		t.Errorf("expected output %q got %q", expected, data)
+	}
+	expected = "grep: " + name + ": input file is also the output\n"
+	if buferr.String() != expected {
+		t.Errorf("expected stderr %q got %q", expected, buferr.String())
+	}
+}
+
+func TestCreateOutput(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "input")
+	if err := os.WriteFile(name, []byte("foo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := name + ": input file is also the output"
+	for _, glob := range []string{name, filepath.Join(dir, "*")} {
+		if _, err := createOutput(name, []string{glob}); err == nil || err.Error() != expected {
+			t.Errorf("%s: expected error %q got %v", glob, expected, err)
+		}
+	}
+	if data, err := os.ReadFile(name); err != nil || string(data) != "foo\n" {
+		t.Errorf("expected the input kept, got %q", data)
+	}
+
+	f, err := createOutput(filepath.Join(dir, "output"), []string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+// recordingFormatter records the calls of the Formatter.
+type recordingFormatter struct {
+	calls []string
+}
+
+func (f *recordingFormatter) FileHeader(name string) {
+	f.calls = append(f.calls, "FileHeader "+name)
+}
+
+func (f *recordingFormatter) Line(r Result) {
+	f.calls = append(f.calls, fmt.Sprintf("Line %s %d %v", r.Name, r.Number, r.Context))
+}
+
+func (f *recordingFormatter) Separator(file bool) {
+	f.calls = append(f.calls, fmt.Sprintf("Separator %v", file))
+}
+
+func (f *recordingFormatter) Count(name string, n int) {
+	f.calls = append(f.calls, fmt.Sprintf("Count %s %d", name, n))
+}
+
+func (f *recordingFormatter) Name(name string) {
+	f.calls = append(f.calls, "Name "+name)
+}
+
+func (f *recordingFormatter) Binary(name string) {
+	f.calls = append(f.calls, "Binary "+name)
+}
+
+func TestFormatter(t *testing.T) {
+	tests := []struct {
+		opts     Options
+		expected []string
+	}{
+		{Options{AfterContext: 1, MaxCount: 1}, []string{
+			"FileHeader ./testdata/golang",
+			"Line ./testdata/golang 4 false",
+			"Line ./testdata/golang 5 true",
+			"Separator true",
+			"FileHeader ./testdata/grep",
+			"Line ./testdata/grep 2 false",
+			"Line ./testdata/grep 3 true",
+		}},
+		{Options{CountTotal: true}, []string{
+			"Count ./testdata/golang 4",
+			"Count ./testdata/grep 12",
+			"Count (total) 16",
+		}},
+		{Options{FilesWithMatch: true}, []string{
+			"Name ./testdata/golang",
+			"Name ./testdata/grep",
+		}},
+	}
+
+	for _, test := range tests {
+		f := &recordingFormatter{}
+		bufout := &bytes.Buffer{}
+		g := &Grepper{Options: test.opts, Stdout: bufout, Stderr: &bytes.Buffer{}, Formatter: f}
+		g.Jobs = 4
+
+		if match, err := g.Search("and", []string{"./testdata/golang", "./testdata/grep"}); err != nil || !match {
+			t.Fatalf("%+v: expected match", test.opts)
+		}
+		if !reflect.DeepEqual(f.calls, test.expected) {
+			t.Errorf("%+v: expected calls\n%q\ngot\n%q", test.opts, test.expected, f.calls)
+		}
+		if bufout.Len() > 0 {
+			t.Errorf("%+v: unexpected output %q", test.opts, bufout)
+		}
+	}
+
+	// Nor is the binary file matching printed.
+	for _, multiline := range []bool{false, true} {
+		f := &recordingFormatter{}
+		bufout := &bytes.Buffer{}
+		g := &Grepper{Options: Options{Multiline: multiline}, Stdout: bufout, Stderr: &bytes.Buffer{}, Formatter: f}
+		if match, err := g.Search("foo", []string{"./testdata/binary"}); err != nil || !match {
+			t.Fatal("expected match")
+		}
+		expected := []string{"Binary ./testdata/binary"}
+		if !reflect.DeepEqual(f.calls, expected) || bufout.Len() > 0 {
+			t.Errorf("multiline %v: expected calls %q got %q and output %q", multiline, expected, f.calls, bufout)
+		}
+	}
+}
+
+// upperFormatter prints the lines upper-cased, by the default formatter.
+type upperFormatter struct {
+	TextFormatter
+}
+
+func (f upperFormatter) Line(r Result) {
+	r.Text = strings.ToUpper(r.Text)
+	f.TextFormatter.Line(r)
+}
+
+func TestEmbeddedFormatter(t *testing.T) {
+	opts := Options{LineNumbers: true, AfterContext: 1}
+	paths := []string{"./testdata/golang"}
+
+	bufout := &bytes.Buffer{}
+	g := &Grepper{Options: opts, Stdout: bufout, Stderr: &bytes.Buffer{}}
+	if _, err := g.Search("and", paths); err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.ToUpper(bufout.String())
+
+	bufout = &bytes.Buffer{}
+	g = &Grepper{Options: opts, Stdout: bufout, Stderr: &bytes.Buffer{}}
+	g.Formatter = upperFormatter{NewTextFormatter(g)}
+	if _, err := g.Search("and", paths); err != nil {
+		t.Fatal(err)
+	}
+	if bufout.String() != expected {
+		t.Fatalf("expected %q got %q", expected, bufout.String())
+	}
+}
+
+func TestExclusiveFlag(t *testing.T) {
+	tests := []struct {
+		args         []string
+		noFilename   bool
+		withFilename bool
+	}{
+		{[]string{"-h"}, true, false},
+		{[]string{"-H"}, false, true},
+		{[]string{"-H", "-h"}, true, false},
+		{[]string{"-h", "-H"}, false, true},
+		{[]string{"-h", "-H", "-h"}, true, false},
+		{[]string{"-h", "-H=false"}, true, false},
+	}
+
+	for _, test := range tests {
+		var opts Options
+		fs := flag.NewFlagSet("grep", flag.ContinueOnError)
+		fs.Var(exclusiveFlag{&opts.NoFilename, &opts.WithFilename}, "h", "")
+		fs.Var(exclusiveFlag{&opts.WithFilename, &opts.NoFilename}, "H", "")
+
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		if opts.NoFilename != test.noFilename || opts.WithFilename != test.withFilename {
+			t.Errorf("%q: expected -h %v and -H %v, got %v and %v", test.args,
+				test.noFilename, test.withFilename, opts.NoFilename, opts.WithFilename)
+		}
+	}
+}
+
+func TestSplitShortFlags(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"-C2", "error", "app.log"}, []string{"-C", "2", "error", "app.log"}},
+		{[]string{"-m1", "pattern"}, []string{"-m", "1", "pattern"}},
+		{[]string{"-rlZ", "pattern", "."}, []string{"-r", "-l", "-Z", "pattern", "."}},
+		{[]string{"-rm2", "-ie", "-x", "-C"}, []string{"-r", "-m", "2", "-i", "-e", "-x", "-C"}},
+		{[]string{"-C", "-2", "-rl"}, []string{"-C", "-2", "-r", "-l"}},
+		{[]string{"--context", "2", "-context=2", "-rl"}, []string{"--context", "2", "-context=2", "-r", "-l"}},
+		{[]string{"-rX", "-rl"}, []string{"-rX", "-r", "-l"}},
+		{[]string{"-r", "--", "-rl"}, []string{"-r", "--", "-rl"}},
+		{[]string{"-r", "-rl", "-", "-rl"}, []string{"-r", "-r", "-l", "-", "-rl"}},
+	}
+
+	for _, test := range tests {
+		fs := flag.NewFlagSet("grep", flag.ContinueOnError)
+		fs.Int("C", 0, "")
+		fs.Int("context", 0, "")
+		fs.Int("m", 0, "")
+		fs.Var(&stringList{}, "e", "")
+		for _, name := range []string{"i", "l", "r", "x", "Z"} {
+			fs.Bool(name, false, "")
+		}
+
+		if got := splitShortFlags(fs, test.args); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%q: expected %q got %q", test.args, test.expected, got)
+		}
+	}
+}
+
+func TestPredicate(t *testing.T) {
+	startsWithM := func(line []byte) bool { return bytes.HasPrefix(line, []byte("m")) }
+
+	tests := []struct {
+		opts     Options
+		pattern  string
+		expected string
+	}{
+		{Options{LineNumbers: true}, "and", "5:make it easy to write programs that get the most out of multicore and networked\n" +
+			"6:machines, while its novel type system enables flexible and modular program\n"},
+		{Options{CountOnly: true}, "", "2\n"},
+		{Options{CountOnly: true}, "the", "1\n"},
+		{Options{CountOnly: true, Invert: true}, "and", "8\n"},
+		{Options{CountOnly: true, Jobs: 4}, "and", "./testdata/golang:2\n"},
+	}
+
+	for _, test := range tests {
+		bufout := &bytes.Buffer{}
+		g := &Grepper{Options: test.opts, Stdout: bufout, Stderr: &bytes.Buffer{}, Predicate: startsWithM}
+
+		paths := []string{"./testdata/golang"}
+		if test.opts.Jobs > 0 {
+			paths = append(paths, "./testdata/grep")
+		}
+		if _, err := g.Search(test.pattern, paths); err != nil {
+			t.Fatal(err)
+		}
+		if bufout.String() != test.expected {
+			t.Errorf("%+v %q: expected %q got %q", test.opts, test.pattern, test.expected, bufout.String())
+		}
+	}
+
+	g := &Grepper{Options: Options{Multiline: true}, Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}, Predicate: startsWithM}
+	if _, err := g.Search("and", []string{"./testdata/golang"}); err == nil {
+		t.Fatal("expected error for --multiline with a Predicate")
+	}
+
+	// The streamed lines are selected by the Predicate too.
+	g = &Grepper{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}, Predicate: startsWithM}
+	results, err := g.SearchStream(context.Background(), "and", []string{"./testdata/golang"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numbers []int
+	for r := range results {
+		numbers = append(numbers, r.Number)
+	}
+	if !reflect.DeepEqual(numbers, []int{5, 6}) {
+		t.Fatalf("expected the lines 5 and 6 streamed, got %v", numbers)
+	}
+}
+
+// syncBuffer is a bytes.Buffer written and read at once.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestFollow(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "log")
+	if err := os.WriteFile(name, []byte("foo 1\nbar\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	appendFile := func(s string) {
+		f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bufout := &syncBuffer{}
+	g := &Grepper{Options: Options{Follow: true, LineNumbers: true}, Stdout: bufout, Stderr: &bytes.Buffer{}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan bool)
+	go func() {
+		match, err := g.SearchContext(ctx, "foo", []string{name})
+		if err != nil && err != context.Canceled {
+			t.Error(err)
+		}
+		done <- match
+	}()
+
+	wait := func(expected string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if bufout.String() == expected {
+				return
 			}
 		}
+		t.Fatalf("expected %q got %q", expected, bufout.String())
+	}
+
+	wait("1:foo 1\n")
+	appendFile("foo 2\nbar\n")
+	wait("1:foo 1\n3:foo 2\n")
+
+	// Truncated, the file is searched again from its beginning.
+	if err := os.Truncate(name, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * followPoll)
+	appendFile("foo 3\n")
+	wait("1:foo 1\n3:foo 2\n5:foo 3\n")
+
+	// Rotated, the new file of the name is followed.
+	if err := os.Rename(name, name+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile("foo 4\n")
+	wait("1:foo 1\n3:foo 2\n5:foo 3\n6:foo 4\n")
+
+	cancel()
+	if !<-done {
+		t.Fatal("expected match")
+	}
+
+	for _, globs := range [][]string{nil, {"-"}, {name, name}} {
+		g := &Grepper{Options: Options{Follow: true}, Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+		if _, err := g.Search("foo", globs); err == nil {
+			t.Errorf("%q: expected error for --follow", globs)
+		}
+	}
+}
+
+func TestGitignore(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		".gitignore":       "# comment\nbuild/\n*.log\n!keep.log\n/top\ndocs/**/draft\n",
+		".git/config":      "foo",
+		"a.log":            "foo",
+		"keep.log":         "foo",
+		"top":              "foo",
+		"build/out":        "foo",
+		"src/main":         "foo",
+		"src/top":          "foo",
+		"src/build":        "foo",
+		"src/.gitignore":   "main\n",
+		"docs/draft":       "foo",
+		"docs/a/b/draft":   "foo",
+		"docs/a/b/final":   "foo",
+		"other/keep.log/x": "foo",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		opts     Options
+		expected []string
+	}{
+		{Options{Recursive: true, Gitignore: true}, []string{
+			"docs/a/b/final", "keep.log", "other/keep.log/x", "src/build", "src/top",
+		}},
+		{Options{Recursive: true, Gitignore: true, Hidden: true}, []string{
+			"docs/a/b/final", "keep.log", "other/keep.log/x", "src/.gitignore", "src/build", "src/top",
+		}},
+		{Options{Recursive: true}, []string{
+			"a.log", "build/out", "docs/a/b/draft", "docs/a/b/final", "docs/draft", "keep.log",
+			"other/keep.log/x", "src/build", "src/main", "src/top", "top",
+		}},
+	}
+
+	for _, test := range tests {
+		bufout := &bytes.Buffer{}
+		g := &Grepper{Options: test.opts, Stdout: bufout, Stderr: &bytes.Buffer{}}
+		g.FilesWithMatch = true
+		g.Sort = "name"
+
+		pattern := "foo"
+		if test.opts.Hidden {
+			pattern = "foo|main"
+		}
+		if _, err := g.Search(pattern, []string{dir}); err != nil {
+			t.Fatal(err)
+		}
+
+		var expected string
+		for _, name := range test.expected {
+			expected += filepath.Join(dir, filepath.FromSlash(name)) + "\n"
+		}
+		if bufout.String() != expected {
+			t.Errorf("%+v: expected %q got %q", test.opts, expected, bufout.String())
+		}
+	}
+}
+
+func TestParseGitignore(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		dir     bool
+		match   bool
+	}{
+		{"*.log", "a/b.log", false, true},
+		{"/*.log", "a/b.log", false, false},
+		{"/*.log", "b.log", false, true},
+		{"build/", "a/build", true, true},
+		{"build/", "a/build", false, false},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"**/b", "x/b", false, true},
+		{"a/**", "a/x/y", false, true},
+		{"a/*", "a/x/y", false, false},
+		{`\#x`, "#x", false, true},
+		{`\!x`, "!x", false, true},
+		{"x\\ ", "x ", false, true},
+		{"x  ", "x", false, true},
+	}
+
+	for _, test := range tests {
+		patterns := parseGitignore(test.pattern)
+		if len(patterns) != 1 {
+			t.Fatalf("%q: expected one pattern, got %d", test.pattern, len(patterns))
+		}
+		if match := patterns[0].match(test.path, test.dir); match != test.match {
+			t.Errorf("%q %q: expected match %v", test.pattern, test.path, test.match)
+		}
+	}
+
+	if patterns := parseGitignore("# comment\n\n  \n!\n"); len(patterns) != 0 {
+		t.Errorf("expected no patterns, got %+v", patterns)
 	}
 }
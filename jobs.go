@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"io"
+)
+
+// jobs returns the number of goroutines searching the files, one if not set.
+func (g *Grepper) jobs() int {
+	if g.Jobs <= 0 {
+		return 1
+	}
+	return g.Jobs
+}
+
+// fileTask is the search of a file by a worker of the pool. The search writes
+// to the buffers of the task, which are written out once all the tasks queued
+// before it are.
+type fileTask struct {
+	g      Grepper // searching the file, writing to the buffers
+	name   string
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+	match  bool
+	done   chan struct{}
+}
+
+// pool is a pool of workers searching the files queued by a Grepper. The
+// output of the files is written in the order they were queued, so it is the
+// same as of the sequential search.
+type pool struct {
+	tasks chan *fileTask // to the workers
+	queue chan *fileTask // to the collector, in the order queued
+
+	// Written by the collector.
+	stdout    io.Writer
+	stderr    io.Writer
+	separator string
+	grouped   bool
+	headed    bool
+	counts    Counter
+	match     bool
+	failed    bool
+	done      chan struct{}
+}
+
+// startPool starts the workers searching the files for the pattern. Until
+// stopPool, the files are queued and the messages of the Grepper itself are
+// written in order with their output.
+func (g *Grepper) startPool(re Matcher) {
+	n := g.jobs()
+	p := &pool{
+		tasks:     make(chan *fileTask, n),
+		queue:     make(chan *fileTask, 4*n),
+		stdout:    g.stdout,
+		stderr:    g.stderr,
+		separator: g.fileSeparator(),
+		grouped:   g.grouped,
+		headed:    g.headed,
+		done:      make(chan struct{}),
+	}
+
+	for i := 0; i < n; i++ {
+		go func() {
+			for t := range p.tasks {
+				t.match = t.g.grepName(t.name, re)
+				close(t.done)
+			}
+		}()
+	}
+	go p.collect()
+
+	g.pool = p
+	g.stderr = p
+}
+
+// stopPool waits for the queued files to be searched and their output to be
+// written. Returns true if any of them match; false otherwise.
+func (g *Grepper) stopPool() bool {
+	p := g.pool
+	close(p.tasks)
+	close(p.queue)
+	<-p.done
+
+	g.pool = nil
+	g.stderr = p.stderr
+	g.grouped = p.grouped
+	g.headed = p.headed
+	g.counts.add(p.counts)
+	g.failed = g.failed || p.failed
+	return p.match
+}
+
+// add queues the named file to be searched like by the Grepper.
+func (p *pool) add(g *Grepper, name string) {
+	t := &fileTask{g: *g, name: name, done: make(chan struct{})}
+	t.g.pool = nil
+	t.g.searched = nil
+	t.g.collected = nil
+	t.g.stdout = &t.stdout
+	t.g.stderr = &t.stderr
+	t.g.format = t.g.formatter()
+	t.g.grouped = false
+	t.g.headed = false
+	t.g.counts = Counter{}
+	t.g.failed = false
+
+	p.queue <- t
+	p.tasks <- t
+}
+
+// Write queues the message of the Grepper, like an error of walking a
+// directory, to be written to the standard error in order with the output of
+// the files.
+func (p *pool) Write(b []byte) (int, error) {
+	t := &fileTask{done: make(chan struct{})}
+	t.stderr.Write(b)
+	close(t.done)
+
+	p.queue <- t
+	return len(b), nil
+}
+
+// collect writes the output of the tasks in the order queued, keeping the
+// state of the search as if the files were searched sequentially.
+func (p *pool) collect() {
+	defer close(p.done)
+
+	for t := range p.queue {
+		<-t.done
+
+		// The group separator of the first group of lines of the file
+		// is up to the groups of the files before it, as is the empty
+		// line before its heading.
+		if p.grouped && t.g.grouped && !t.g.heading() {
+			io.WriteString(p.stdout, p.separator)
+		}
+		if p.headed && t.g.headed {
+			io.WriteString(p.stdout, t.g.lineEnd())
+		}
+		p.grouped = p.grouped || t.g.grouped
+		p.headed = p.headed || t.g.headed
+		p.counts.add(t.g.counts)
+		p.match = p.match || t.match
+		p.failed = p.failed || t.g.failed
+
+		p.stdout.Write(t.stdout.Bytes())
+		p.stderr.Write(t.stderr.Bytes())
+	}
+}
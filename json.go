@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// jsonMatch is a match printed by the --json.
+type jsonMatch struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"` // of the match in the line, in bytes from 1
+	Text   string `json:"text"`
+	Match  string `json:"match"`
+}
+
+// jsonCount is a count printed by the --json with the -c, without the file
+// for the total of the --count-total.
+type jsonCount struct {
+	File  string `json:"file,omitempty"`
+	Count int    `json:"count"`
+}
+
+// jsonName is a name of a file listed by the --json with the -l or -L.
+type jsonName struct {
+	File string `json:"file"`
+}
+
+// jsonBinary is a binary file matching printed by the --json.
+type jsonBinary struct {
+	File   string `json:"file"`
+	Binary bool   `json:"binary"`
+}
+
+// JSONFormatter prints the lines as the text one, but the selected ones as
+// JSON objects, by the --json.
+type JSONFormatter struct {
+	TextFormatter
+}
+
+// NewJSONFormatter returns the JSONFormatter writing to the output of the
+// searches of the Grepper, as by its options.
+func NewJSONFormatter(g *Grepper) JSONFormatter {
+	return JSONFormatter{TextFormatter{g}}
+}
+
+// Line prints the matches of the line as JSON objects, one per line. The
+// line without any, like selected by the -v, is printed once with the zero
+// column and an empty match.
+func (f JSONFormatter) Line(r Result) {
+	m := jsonMatch{File: r.Name, Line: r.Number, Text: r.Text}
+	if len(r.Matches) == 0 {
+		f.encode(m)
+		return
+	}
+
+	for _, loc := range r.Matches {
+		m.Column = loc[0] + 1
+		m.Match = r.Text[loc[0]:loc[1]]
+		f.encode(m)
+	}
+}
+
+// Count prints the count as a JSON object, named by the file unless the
+// total.
+func (f JSONFormatter) Count(name string, n int) {
+	c := jsonCount{Count: n}
+	if name != totalName {
+		c.File = name
+	}
+	f.encode(c)
+}
+
+// Name prints the name as a JSON object, even of a single file.
+func (f JSONFormatter) Name(name string) {
+	f.encode(jsonName{File: name})
+}
+
+// Binary prints the binary file matching as a JSON object, instead of its
+// lines.
+func (f JSONFormatter) Binary(name string) {
+	f.encode(jsonBinary{File: name, Binary: true})
+}
+
+// encode prints the value as JSON on its own line, the HTML characters not
+// escaped.
+func (f JSONFormatter) encode(v interface{}) {
+	enc := json.NewEncoder(f.g.stdout)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
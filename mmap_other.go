@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile fails, the files are not mapped on this platform.
+func mmapFile(f *os.File) ([]byte, error) {
+	return nil, errors.New("cannot map the file")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
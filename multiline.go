@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// checkMultiline returns an error if the options are not supported with the
+// --multiline.
+func (g *Grepper) checkMultiline() error {
+	if !g.Multiline {
+		return nil
+	}
+
+	before, after := g.contextLines()
+	switch {
+	case g.Invert:
+		return errors.New("--multiline is not supported with the -v")
+	case before > 0 || after > 0 || g.Passthru:
+		return errors.New("--multiline is not supported with the context lines or --passthru")
+	case g.Rewrite != "":
+		return errors.New("--multiline is not supported with the --rewrite")
+	case g.Predicate != nil:
+		return errors.New("--multiline is not supported with a Predicate")
+	}
+	return nil
+}
+
+// readAll reads the whole input for the --multiline. Returns false if the
+// input is larger than the MaxFilesize, telling so.
+func (g *Grepper) readAll(name string, in io.Reader) ([]byte, bool, error) {
+	if g.MaxFilesize == 0 {
+		data, err := ioutil.ReadAll(in)
+		return data, true, err
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(in, int64(g.MaxFilesize)+1))
+	if err != nil {
+		return nil, false, err
+	}
+	return data, !g.tooLarge(name, int64(len(data))), nil
+}
+
+// grepMultiline searches the whole content of the file for the matches
+// spanning lines, like the grepLines. The lines spanned by each match, and
+// by the matches on the same lines, are printed as one.
+func (g *Grepper) grepMultiline(name string, data []byte, pattern Matcher) (bool, error) {
+	head := data
+	if len(head) > binaryPeek {
+		head = head[:binaryPeek]
+	}
+	binary := g.isBinary(head)
+	if binary && g.SkipBinary {
+		return false, nil
+	}
+
+	text := string(data)
+	term := g.lineEnd()[0]
+	var counts Counter
+
+	// The line number of the offset counted up to.
+	lineNumber, counted := 1, 0
+	numberAt := func(offset int) int {
+		lineNumber += strings.Count(text[counted:offset], string(term))
+		counted = offset
+		return lineNumber
+	}
+
+	// The distinct parts printed by the -o, with the --unique.
+	var printed map[string]bool
+	switch {
+	case g.UniqueGlobal:
+		printed = g.printed
+	case g.Unique:
+		printed = make(map[string]bool)
+	}
+
+	headed := false
+	printLine := func(line inputLine) {
+		if !headed {
+			g.format.FileHeader(name)
+			headed = true
+		}
+		g.printLine(name, line, ":")
+	}
+
+	var locs [][]int
+	if g.OnlyMatching {
+		locs = g.onlyMatches(pattern, text)
+	} else {
+		locs = pattern.FindAllStringIndex(text, -1)
+	}
+
+	maxed := false
+	for i := 0; i < len(locs) && !maxed && !g.canceled(); {
+		// A match at the end of the last line is past the lines.
+		if locs[i][0] == len(text) && (len(text) == 0 || text[len(text)-1] == term) {
+			break
+		}
+
+		// The lines spanned by the match and the following matches
+		// starting on them.
+		start := strings.LastIndexByte(text[:locs[i][0]], term) + 1
+		end := lineEndOf(text, locs[i], term)
+		j := i + 1
+		for ; j < len(locs) && locs[j][0] <= end; j++ {
+			if e := lineEndOf(text, locs[j], term); e > end {
+				end = e
+			}
+		}
+		spanned := locs[i:j]
+		i = j
+
+		if g.FilesWithoutMatch || g.quitting() || g.FilesWithMatch && !g.counting() {
+			g.counts.add(Counter{Lines: 1, Files: 1})
+			switch {
+			case g.FilesWithoutMatch:
+				return false, nil
+			case g.quitting():
+				return true, nil
+			}
+			g.format.Name(name)
+			return true, nil
+		}
+
+		counts.Lines++
+		for _, loc := range spanned {
+			if loc[0] < loc[1] {
+				counts.Matches++
+			}
+		}
+		if g.countingMatches() && g.MaxCount > 0 && counts.Matches > g.MaxCount {
+			counts.Matches = g.MaxCount
+		}
+		maxed = g.MaxCount > 0 && g.count(counts) >= g.MaxCount ||
+			g.TotalMax > 0 && g.counts.Lines+counts.Lines >= g.TotalMax
+
+		if g.counting() {
+			continue
+		}
+
+		if binary {
+			g.format.Binary(name)
+			return true, nil
+		}
+
+		if g.OnlyMatching && !g.JSON {
+			for _, loc := range spanned {
+				if loc[0] == loc[1] {
+					continue
+				}
+				lineStart := strings.LastIndexByte(text[:loc[0]], term) + 1
+				match := inputLine{
+					text:    text[loc[0]:loc[1]],
+					number:  numberAt(loc[0]),
+					offset:  int64(loc[0]),
+					column:  g.Column.of(text[lineStart:], []int{loc[0] - lineStart, loc[1] - lineStart}),
+					matches: [][]int{{0, loc[1] - loc[0]}},
+				}
+				if g.Replace != "" {
+					match.text = string(pattern.(replacer).ExpandString(nil, g.Replace, text, loc))
+					match.matches = [][]int{{0, len(match.text)}}
+				}
+				if printed != nil {
+					if printed[match.text] {
+						continue
+					}
+					printed[match.text] = true
+				}
+				printLine(match)
+			}
+			continue
+		}
+
+		line := inputLine{
+			text:   text[start:end],
+			number: numberAt(start),
+			offset: int64(start),
+		}
+		for _, loc := range spanned {
+			line.matches = append(line.matches, []int{loc[0] - start, loc[1] - start})
+		}
+		line.column = g.Column.of(line.text, line.matches[0])
+		if g.Replace != "" && !g.JSON {
+			line.text = pattern.(replacer).ReplaceAllString(line.text, g.Replace)
+			line.matches = nil
+		}
+		printLine(line)
+	}
+
+	g.endFile(name, counts)
+	return counts.Lines > 0, nil
+}
+
+// lineEndOf returns the offset of the terminator of the last line spanned by
+// the match in the text, or the length of the text if that line is not
+// terminated.
+func lineEndOf(text string, loc []int, term byte) int {
+	last := loc[1] - 1
+	if last < loc[0] {
+		last = loc[0]
+	}
+	if last < len(text) {
+		if k := strings.IndexByte(text[last:], term); k >= 0 {
+			return last + k
+		}
+	}
+	return len(text)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// Query is a pattern compiled with the options, to be searched for many
+// times without compiling it again. A Query is not modified by the searches,
+// so it can be used by several at once.
+type Query struct {
+	opts Options
+	re   Matcher
+}
+
+// Compile compiles the pattern as for the Search with the options. The error
+// is returned for an invalid pattern.
+func Compile(pattern string, opts Options) (*Query, error) {
+	return CompilePatterns(strings.Split(pattern, "\n"), opts)
+}
+
+// CompilePatterns is like the Compile, but for the patterns given one by one,
+// which may contain newlines.
+func CompilePatterns(patterns []string, opts Options) (*Query, error) {
+	re, err := NewGrepper(opts).compilePatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return &Query{opts: opts, re: re}, nil
+}
+
+// Options returns the options the query was compiled with.
+func (q *Query) Options() Options {
+	return q.opts
+}
+
+// Search searches like the Search of a Grepper with the options of the
+// query, reading the standard input and writing to the standard output and
+// error.
+func (q *Query) Search(globs []string) (bool, error) {
+	return q.SearchContext(context.Background(), globs)
+}
+
+// SearchContext is like the Search, but stops searching once the ctx is
+// canceled.
+func (q *Query) SearchContext(ctx context.Context, globs []string) (bool, error) {
+	return NewGrepper(q.opts).SearchQuery(ctx, q, globs)
+}
+
+// SearchQuery is like the SearchContext, but searches for the compiled
+// pattern of the query. The Options of the Grepper are set to those of the
+// query.
+func (g *Grepper) SearchQuery(ctx context.Context, q *Query, globs []string) (bool, error) {
+	g.Options = q.opts
+	g.ctx = ctx
+	defer func() { g.ctx = nil }()
+
+	match, err := g.search(q.re, globs)
+	if err == nil {
+		err = ctx.Err()
+	}
+	return match, err
+}
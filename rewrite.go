@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// checkRewrite returns an error if the files cannot be rewritten by the
+// --rewrite, being the standard input or with the options not supported.
+func (g *Grepper) checkRewrite(globs []string) error {
+	if g.Rewrite == "" {
+		return nil
+	}
+
+	switch {
+	case g.Invert:
+		return errors.New("--rewrite is not supported with the -v")
+	case g.Gzip || g.Encoding != "":
+		return errors.New("--rewrite is not supported with the --gzip or --encoding")
+	case len(globs) == 0 && g.FilesFrom == "":
+		return errors.New("--rewrite does not rewrite the standard input")
+	}
+	for _, glob := range globs {
+		if glob == "-" {
+			return errors.New("--rewrite does not rewrite the standard input")
+		}
+	}
+	return nil
+}
+
+// rewriteFile rewrites the named file with the matches replaced by the
+// template of the Rewrite, printing the rewritten lines. Returns true if any
+// line is rewritten; false otherwise.
+func (g *Grepper) rewriteFile(name string, re Matcher) bool {
+	// The file linked is rewritten, not the link.
+	path, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		g.openErrorf("grep: %s\n", err)
+		return false
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		g.openErrorf("grep: %s\n", err)
+		return false
+	}
+	if g.tooLarge(name, fi.Size()) {
+		return false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		g.openErrorf("grep: %s\n", err)
+		return false
+	}
+
+	head := data
+	if len(head) > binaryPeek {
+		head = head[:binaryPeek]
+	}
+	if g.isBinary(head) {
+		return false
+	}
+	g.counts.Searched++
+
+	name = g.displayName(name)
+	term := g.lineEnd()[0]
+
+	var out bytes.Buffer
+	var counts Counter
+	for offset, number := 0, 1; offset < len(data); number++ {
+		line, end := data[offset:], ""
+		if i := bytes.IndexByte(line, term); i >= 0 {
+			line, end = line[:i], string(term)
+		}
+		next := offset + len(line) + len(end)
+
+		// The matches are replaced as searched, before the CR of CRLF.
+		if !g.Binary && term == '\n' && bytes.HasSuffix(line, []byte("\r")) {
+			line, end = line[:len(line)-1], "\r"+end
+		}
+
+		text := string(line)
+		if re.MatchString(text) && (g.Predicate == nil || g.Predicate(line)) {
+			if counts.Lines == 0 {
+				g.format.FileHeader(name)
+			}
+			counts.Lines++
+			counts.Matches += countMatches(re, text)
+			text = re.(replacer).ReplaceAllString(text, g.Rewrite)
+			g.printLine(name, inputLine{text: text, number: number, offset: int64(offset)}, ":")
+		}
+		out.WriteString(text)
+		out.WriteString(end)
+		offset = next
+	}
+
+	if counts.Lines == 0 {
+		return false
+	}
+	counts.Files = 1
+	g.counts.add(counts)
+
+	if err := g.replaceFile(path, fi, data, out.Bytes()); err != nil {
+		g.errorf("grep: %s: %s\n", name, err)
+	}
+	return true
+}
+
+// replaceFile replaces the content of the file of the path, the old one, by
+// the data at once, renaming a temporary file synced next to it. The mode and
+// owner of the file, its fi, are kept. Unless the Confirm, the old content is
+// kept in the file with the .bak suffix.
+func (g *Grepper) replaceFile(path string, fi os.FileInfo, old, data []byte) error {
+	if !g.Confirm {
+		if err := os.WriteFile(path+".bak", old, fi.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	// Nothing is removed once renamed.
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	// Only a privileged user may give the file away.
+	chown(tmp, fi)
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// ignoreSigpipe does nothing, there is no SIGPIPE on this platform.
+func ignoreSigpipe() {}
+
+// isBrokenPipe reports whether the err is of writing to a pipe closed by
+// its reader, only the io.Pipe on this platform.
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, io.ErrClosedPipe)
+}
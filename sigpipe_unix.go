@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os/signal"
+	"syscall"
+)
+
+// ignoreSigpipe makes the writes to a broken pipe fail instead of killing the
+// process, so the search stops cleanly.
+func ignoreSigpipe() {
+	signal.Ignore(syscall.SIGPIPE)
+}
+
+// isBrokenPipe reports whether the err is of writing to a pipe closed by
+// its reader.
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrClosedPipe)
+}
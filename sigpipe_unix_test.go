@@ -0,0 +1,60 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// brokenPipe is a writer failing like a pipe closed by its reader, counting
+// the writes.
+type brokenPipe struct {
+	writes int
+}
+
+func (b *brokenPipe) Write(p []byte) (int, error) {
+	b.writes++
+	return 0, &os.PathError{Op: "write", Path: "|1", Err: syscall.EPIPE}
+}
+
+func TestBrokenPipe(t *testing.T) {
+	input := strings.Repeat("match\n", 100000)
+
+	for _, jobs := range []int{1, 4} {
+		in := &countingReader{r: strings.NewReader(input)}
+		out := &brokenPipe{}
+		g := &Grepper{
+			Options: Options{Jobs: jobs},
+			Stdin:   in,
+			Stdout:  out,
+			Stderr:  &bytes.Buffer{},
+		}
+
+		match, err := g.Search("match", []string{"-", "./testdata/golang"})
+		if !errors.Is(err, syscall.EPIPE) {
+			t.Fatal("expected broken pipe, got", err)
+		}
+		if !match {
+			t.Fatal("expected match before the pipe broken")
+		}
+		// The jobs read the whole file before its output is written.
+		if jobs == 1 && in.n == len(input) {
+			t.Fatal("expected the search stopped before reading all input")
+		}
+		if out.writes != 1 {
+			t.Fatalf("expected no writes once the pipe broken, got %d", out.writes)
+		}
+
+		g.Stdin = strings.NewReader(input)
+		g.Stdout = &brokenPipe{}
+		if code := run(context.Background(), g, []string{"match"}, nil); code != 0 {
+			t.Fatal("expected exit code 0 if the pipe broken, got", code)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+)
+
+// sortFlag is a flag.Value for the --sort, the order of the searched files,
+// one of name, size or mtime.
+type sortFlag string
+
+func (s *sortFlag) String() string {
+	if s == nil {
+		return ""
+	}
+	return string(*s)
+}
+
+func (s *sortFlag) Set(v string) error {
+	switch v {
+	case "name", "size", "mtime":
+		*s = sortFlag(v)
+		return nil
+	}
+	return errors.New("must be name, size or mtime")
+}
+
+// sortedFile is a file collected to be searched in the order of the --sort.
+type sortedFile struct {
+	name      string
+	printName bool
+	size      int64
+	mtime     time.Time
+}
+
+// collectFile collects the named file to be searched once all are collected
+// and sorted.
+func (g *Grepper) collectFile(name string) {
+	f := sortedFile{name: name, printName: g.printName}
+	if fi, err := os.Stat(name); err == nil {
+		f.size = fi.Size()
+		f.mtime = fi.ModTime()
+	}
+	g.collected = append(g.collected, f)
+}
+
+// sortFiles sorts the files by the key, keeping the order of the equal ones.
+func sortFiles(files []sortedFile, key sortFlag, reverse bool) {
+	less := func(a, b sortedFile) bool {
+		switch key {
+		case "size":
+			return a.size < b.size
+		case "mtime":
+			return a.mtime.Before(b.mtime)
+		}
+		return a.name < b.name
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		if reverse {
+			return less(files[j], files[i])
+		}
+		return less(files[i], files[j])
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+)
+
+// Result is a line found by the SearchStream.
+type Result struct {
+	Name    string  // of the file, or the label of the standard input
+	Number  int     // of the line, from 1
+	Offset  int64   // of the line in the file, in bytes
+	Text    string  // of the line, without the line terminator
+	Matches [][]int // the locations of the matches in the Text
+	Context bool    // a line of the context, not selected
+	Column  int     // of the first match, from 1, by the --column; or 0
+}
+
+// SearchStream searches like the Search, but sends the found lines to the
+// returned channel instead of printing them. The channel is closed once the
+// search is done or the ctx canceled, which stops it even in the middle of a
+// file. The options printing the counts or names instead of the lines, the
+// Replace, Rewrite and the Quiet, are ignored. The error is returned for an
+// invalid pattern, the errors of the files are printed to the Stderr.
+func (g *Grepper) SearchStream(ctx context.Context, pattern string, globs []string) (<-chan Result, error) {
+	s := &Grepper{Options: g.Options, Stdin: g.Stdin, Stdout: ioutil.Discard, Stderr: g.Stderr, Predicate: g.Predicate}
+	s.Jobs = 1
+	s.CountOnly, s.CountMatches, s.CountTotal = false, false, false
+	s.FilesWithMatch, s.FilesWithoutMatch = false, false
+	s.Quiet = false
+	s.Replace, s.Rewrite = "", ""
+
+	re, err := s.compilePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(chan Result)
+	s.ctx = ctx
+	s.results = results
+
+	go func() {
+		defer close(results)
+
+		if _, err := s.search(re, globs); err != nil {
+			fmt.Fprintln(s.Stderr, err)
+		}
+	}()
+
+	return results, nil
+}
+
+// cancelLines is the number of lines scanned between the checks of the
+// context of the search.
+const cancelLines = 1024
+
+// canceled reports whether the context of the search is canceled.
+func (g *Grepper) canceled() bool {
+	return g.ctx != nil && g.ctx.Err() != nil
+}
+
+// sendResult sends the line to the results, unless the search is canceled.
+func (g *Grepper) sendResult(r Result) {
+	if g.canceled() {
+		return
+	}
+
+	select {
+	case g.results <- r:
+	case <-g.ctx.Done():
+	}
+}
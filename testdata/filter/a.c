@@ -0,0 +1 @@
+foo in source
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// grepDir searches all regular files under the root directory. Symbolic
+// links are followed only if Dereference. Returns true if any match;
+// false otherwise.
+func (g *Grepper) grepDir(root string, re Matcher) bool {
+	// Files found in the directory are always named.
+	g.printName = !g.NoFilename
+
+	return g.walkDir(root, re, nil, 0)
+}
+
+// walkDir searches all files under the root directory. The chain holds the
+// resolved directories already being walked, so the followed symbolic links
+// leading back to them are detected. The depth is of the files in the root,
+// for the MaxDepth.
+func (g *Grepper) walkDir(root string, re Matcher, chain []string, depth int) bool {
+	if g.Dereference {
+		dir, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			g.openErrorf("grep: %s\n", err)
+			return false
+		}
+		chain = append(chain[:len(chain):len(chain)], dir)
+	}
+
+	// The trailing separator makes filepath.WalkDir descend into the root
+	// even if it is a symbolic link.
+	if !strings.HasSuffix(root, string(filepath.Separator)) {
+		root += string(filepath.Separator)
+	}
+
+	match := false
+	ignores := make(gitignore)
+
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if g.canceled() || g.quitting() && match || g.totalMaxed() {
+			return filepath.SkipAll
+		}
+
+		if err != nil {
+			g.openErrorf("grep: %s\n", err)
+			return nil
+		}
+
+		if path != root && g.skipped(root, path, d, ignores) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if g.Gitignore && d.IsDir() {
+			ignores.load(path)
+		}
+
+		if d.IsDir() {
+			if path != root && (g.ExcludeDir.match(d.Name()) || g.MaxDepth.exceeded(depth+walkDepth(root, path)+1)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		path = walkName(root, path)
+
+		if g.Dereference && d.Type()&fs.ModeSymlink != 0 {
+			fi, err := os.Stat(path)
+			if err != nil {
+				g.openErrorf("grep: %s\n", err)
+				return nil
+			}
+
+			if fi.IsDir() {
+				subdepth := depth + walkDepth(root, path) + 1
+				if g.ExcludeDir.match(d.Name()) || g.MaxDepth.exceeded(subdepth) {
+					return nil
+				}
+				if isLoop(path, chain) {
+					if !g.NoErrorMessages {
+						fmt.Fprintf(g.stderr, "grep: %s: warning: recursive directory loop\n", path)
+					}
+				} else if g.walkDir(path, re, chain, subdepth) {
+					match = true
+				}
+				return nil
+			}
+
+			if !fi.Mode().IsRegular() && !g.readDevice(fi.Mode()) {
+				return nil
+			}
+		} else if !d.Type().IsRegular() && !g.readDevice(d.Type()) {
+			return nil
+		}
+
+		if !g.included(path) || g.TextOnly && !g.isText(path) || g.repeated(path) {
+			return nil
+		}
+
+		if g.grepName(path, re) {
+			match = true
+		}
+		return nil
+	})
+
+	return match
+}
+
+// skipped reports whether the entry found under the root is skipped, hidden
+// or ignored by the --gitignore.
+func (g *Grepper) skipped(root, path string, d fs.DirEntry, ignores gitignore) bool {
+	switch {
+	case !g.Hidden && strings.HasPrefix(d.Name(), "."):
+		return true
+	case !g.Gitignore:
+		return false
+	}
+	return d.IsDir() && d.Name() == ".git" || ignores.ignored(root, path, d.IsDir())
+}
+
+// isLoop reports whether the directory linked by the path is an ancestor of
+// the path or one of the directories in the chain or their ancestor.
+func isLoop(path string, chain []string) bool {
+	dir, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+
+	if parent, err := filepath.EvalSymlinks(filepath.Dir(path)); err == nil {
+		chain = append(chain[:len(chain):len(chain)], parent)
+	}
+
+	for _, c := range chain {
+		rel, err := filepath.Rel(dir, c)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkName returns the path found under the root as if the root, as given by
+// the user, was its prefix. The filepath.WalkDir cleans the paths.
+func walkName(root, path string) string {
+	rel, err := filepath.Rel(filepath.Clean(root), path)
+	if err != nil || rel == "." {
+		return path
+	}
+	if strings.HasSuffix(root, string(filepath.Separator)) {
+		return root + rel
+	}
+	return root + string(filepath.Separator) + rel
+}
+
+// walkDepth returns the depth of the path found under the root, 0 for the
+// entries of the root itself.
+func walkDepth(root, path string) int {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator))
+}
+
+// depthFlag is a flag.Value for a limit of the depth of the recursion. The
+// zero value means no limit, otherwise it is the limit plus one.
+type depthFlag int
+
+func (d *depthFlag) String() string {
+	if d == nil || *d == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(*d) - 1)
+}
+
+func (d *depthFlag) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return errors.New("must not be negative")
+	}
+	*d = depthFlag(n + 1)
+	return nil
+}
+
+// exceeded reports whether the depth is over the limit.
+func (d depthFlag) exceeded(depth int) bool {
+	return d > 0 && depth > int(d)-1
+}
+
+// devicesFlag is the flag.Value of the --devices, read or skip. Empty by
+// default.
+type devicesFlag string
+
+func (d *devicesFlag) String() string {
+	if d == nil {
+		return ""
+	}
+	return string(*d)
+}
+
+func (d *devicesFlag) Set(s string) error {
+	switch s {
+	case "read", "skip":
+		*d = devicesFlag(s)
+		return nil
+	}
+	return errors.New("must be read or skip")
+}
+
+// isDevice reports whether the file of the mode is a device, a FIFO or a
+// socket.
+func isDevice(mode fs.FileMode) bool {
+	return mode&(fs.ModeDevice|fs.ModeCharDevice|fs.ModeNamedPipe|fs.ModeSocket) != 0
+}
+
+// readDevice reports whether the file of the mode found under a directory is
+// a device read by the --devices=read.
+func (g *Grepper) readDevice(mode fs.FileMode) bool {
+	return g.Devices == "read" && isDevice(mode)
+}
+
+// included reports whether the file passes the --include and --exclude
+// filters. The --exclude takes precedence.
+func (g *Grepper) included(name string) bool {
+	base := filepath.Base(name)
+	if g.Exclude.match(base) {
+		return false
+	}
+	return len(g.Include) == 0 || g.Include.match(base)
+}
+
+// sniffLen is the size of the beginning of the files sniffed by the
+// --text-only.
+const sniffLen = 512
+
+// isText reports whether the content of the named file is text, or gzip
+// compressed with the Gzip. The unreadable files are text, so their error is
+// reported by the search.
+func (g *Grepper) isText(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return true
+	}
+
+	typ := http.DetectContentType(head[:n])
+	return strings.HasPrefix(typ, "text/") || g.Gzip && typ == "application/x-gzip"
+}
+
+// expandGlob returns the names of the files matching the glob, like the
+// filepath.Glob, so the globs are expanded even if the shell does not. A **
+// element of the glob matches any number of nested directories, none too, or
+// at the end all the files under the directory.
+func expandGlob(glob string) ([]string, error) {
+	elems := strings.FieldsFunc(glob, func(r rune) bool { return r == '/' || r == filepath.Separator })
+	star := -1
+	for i, e := range elems {
+		if e == "**" {
+			star = i
+			break
+		}
+	}
+	if star < 0 {
+		return filepath.Glob(glob)
+	}
+
+	sep := string(filepath.Separator)
+	prefix := strings.Join(elems[:star], sep)
+	if os.IsPathSeparator(glob[0]) {
+		prefix = sep + prefix
+	}
+	rest := strings.Join(elems[star+1:], sep)
+
+	bases := []string{"."}
+	if prefix != "" {
+		var err error
+		if bases, err = filepath.Glob(prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	var names []string
+	found := make(map[string]bool)
+	for _, base := range bases {
+		err := filepath.WalkDir(base, func(path string, d fs.DirEntry, err error) error {
+			switch {
+			case err != nil:
+				return nil
+			case rest == "":
+				if !d.IsDir() && !found[path] {
+					found[path] = true
+					names = append(names, path)
+				}
+				return nil
+			case !d.IsDir():
+				return nil
+			}
+
+			matches, err := expandGlob(filepath.Join(path, rest))
+			for _, m := range matches {
+				if !found[m] {
+					found[m] = true
+					names = append(names, m)
+				}
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// globList is a flag.Value collecting the glob patterns of a repeated flag.
+type globList []string
+
+func (l *globList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *globList) Set(glob string) error {
+	if _, err := filepath.Match(glob, ""); err != nil {
+		return err
+	}
+	*l = append(*l, glob)
+	return nil
+}
+
+// match reports whether the name matches any of the glob patterns.
+func (l globList) match(name string) bool {
+	for _, glob := range l {
+		if ok, _ := filepath.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}